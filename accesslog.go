@@ -0,0 +1,133 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat selects the format of the access log.
+type AccessLogFormat int
+
+// The supported access log formats. AccessLogCommon is the Apache common
+// log format followed by the duration in microseconds, as Apache's %D.
+// AccessLogJSON logs one JSON object per request.
+const (
+	AccessLogCommon AccessLogFormat = iota
+	AccessLogJSON
+)
+
+// WithAccessLog writes a line to w, in the given format, for each request
+// handled, including the method, path, status, response size and duration.
+func WithAccessLog(w io.Writer, format AccessLogFormat) Opt {
+	return func(sjc *Handler) error {
+		if format != AccessLogCommon && format != AccessLogJSON {
+			return fmt.Errorf("unknown access log format %d", format)
+		}
+		sjc.accessLog = &accessLog{w: w, format: format}
+		return nil
+	}
+}
+
+type accessLog struct {
+	sync.Mutex
+	w      io.Writer
+	format AccessLogFormat
+}
+
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Remote     string  `json:"remote"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+func (l *accessLog) log(r *http.Request, rw *accessLogWriter, start time.Time) {
+	d := time.Since(start)
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	var line []byte
+	switch l.format {
+	case AccessLogJSON:
+		line, _ = json.Marshal(accessLogEntry{
+			Time:       start.Format(time.RFC3339Nano),
+			Remote:     host,
+			Method:     r.Method,
+			Path:       r.URL.RequestURI(),
+			Status:     rw.status,
+			Bytes:      rw.bytes,
+			DurationMS: float64(d) / float64(time.Millisecond),
+		})
+	default:
+		user := "-"
+		if u, ok := UserFromContext(r.Context()); ok && u != "" {
+			user = u
+		}
+		line = []byte(fmt.Sprintf("%s - %s [%s] %q %d %d %d",
+			host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+			rw.status, rw.bytes, d.Microseconds()))
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.w.Write(append(line, '\n'))
+}
+
+// accessLogWriter records the status and size of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	wrote  bool
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.status = code
+		w.wrote = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(bs []byte) (int, error) {
+	w.wrote = true
+	n, err := w.ResponseWriter.Write(bs)
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements http.Flusher, so streamed responses are still flushed.
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
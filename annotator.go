@@ -0,0 +1,103 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"strings"
+)
+
+type staticAnnotator []Annotation
+
+// StaticAnnotator returns an Annotator that serves annotations from anns,
+// such as a list of deploy events. Annotations are returned if they fall
+// within, or for regions overlap, the requested range. The annotation query
+// is treated as a list of tags separated by spaces or commas, each
+// optionally prefixed by #; only annotations carrying all of the tags are
+// returned.
+func StaticAnnotator(anns []Annotation) Annotator {
+	return staticAnnotator(append([]Annotation(nil), anns...))
+}
+
+// ParseAnnotationTagQuery splits an annotation query into tags. Tags are
+// separated by spaces or commas, and may be prefixed by #, which is removed.
+func ParseAnnotationTagQuery(query string) []string {
+	tags := strings.FieldsFunc(query, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	for i := range tags {
+		tags[i] = strings.TrimPrefix(tags[i], "#")
+	}
+	return tags
+}
+
+// WithServerSideAnnotationTagFilter parses the annotation query with
+// ParseAnnotationTagQuery and drops any annotations returned by the
+// Annotator that do not carry all of the tags.
+func WithServerSideAnnotationTagFilter() Opt {
+	return func(sjc *Handler) error {
+		sjc.annotationTagFilter = true
+		return nil
+	}
+}
+
+func filterAnnotationsByTags(anns []Annotation, tags []string) []Annotation {
+	var out []Annotation
+	for _, a := range anns {
+		if hasAllTags(a.Tags, tags) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func (sa staticAnnotator) GrafanaAnnotations(ctx context.Context, query string, args AnnotationsArguments) ([]Annotation, error) {
+	tags := ParseAnnotationTagQuery(query)
+
+	var out []Annotation
+	for _, a := range sa {
+		end := a.TimeEnd
+		if end.IsZero() {
+			end = a.Time
+		}
+		if !args.From.IsZero() && end.Before(args.From) {
+			continue
+		}
+		if !args.To.IsZero() && a.Time.After(args.To) {
+			continue
+		}
+		if !hasAllTags(a.Tags, tags) {
+			continue
+		}
+		out = append(out, a)
+	}
+
+	return out, nil
+}
+
+func hasAllTags(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
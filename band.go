@@ -0,0 +1,90 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// BandPoint is a value with lower and upper bounds at a point in time.
+type BandPoint struct {
+	Time                time.Time
+	Value, Lower, Upper float64
+}
+
+// BandSeries is a series of values with bounds, for band or range
+// visualisations.
+type BandSeries []BandPoint
+
+// A BandQuerier responds to queries for targets of type "band", e.g.
+// {"target": "latency", "type": "band"}. Each point is sent as an object,
+// {"time": 1000, "value": 2, "lower": 1, "upper": 3}, and the series is
+// marked with "type": "band". Band series are not downsampled.
+type BandQuerier interface {
+	GrafanaBandQuery(ctx context.Context, target string, args QueryArguments) (BandSeries, error)
+}
+
+// WithBandQuerier adds a handler for "band" queries.
+func WithBandQuerier(q BandQuerier) Opt {
+	return func(sjc *Handler) error {
+		sjc.bandQuery = q
+		return nil
+	}
+}
+
+type simpleJSONBandPoint struct {
+	Time  simpleJSONPointTime `json:"time"`
+	Value simpleJSONValue     `json:"value"`
+	Lower simpleJSONValue     `json:"lower"`
+	Upper simpleJSONValue     `json:"upper"`
+}
+
+type simpleJSONBandData struct {
+	Target     string                `json:"target"`
+	Type       string                `json:"type"`
+	DataPoints []simpleJSONBandPoint `json:"datapoints"`
+}
+
+func (h *Handler) jsonBandQuery(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) (interface{}, error) {
+	args := req.queryArguments(target)
+	release, err := h.acquireBackend(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.bandQuery.GrafanaBandQuery(ctx, target.Target, args)
+	release()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Time.Before(resp[j].Time) })
+	if h.seriesDescending {
+		for i, j := 0, len(resp)-1; i < j; i, j = i+1, j-1 {
+			resp[i], resp[j] = resp[j], resp[i]
+		}
+	}
+
+	out := simpleJSONBandData{Target: target.Target, Type: "band", DataPoints: []simpleJSONBandPoint{}}
+	for _, p := range resp {
+		out.DataPoints = append(out.DataPoints, simpleJSONBandPoint{
+			Time:  h.pointTime(p.Time),
+			Value: simpleJSONValue(h.replaceInf(p.Value)),
+			Lower: simpleJSONValue(h.replaceInf(p.Lower)),
+			Upper: simpleJSONValue(h.replaceInf(p.Upper)),
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WithQueryCache caches the datapoints returned by the Querier for each
+// timeserie target for ttl. Targets are cached by name and query arguments,
+// using the raw range, e.g. now-6h, when Grafana sends one, so that
+// refreshes of relative ranges are served from the cache.
+func WithQueryCache(ttl time.Duration) Opt {
+	return func(sjc *Handler) error {
+		if ttl <= 0 {
+			return errors.New("query cache ttl must be positive")
+		}
+		sjc.cacheTTL = ttl
+		return nil
+	}
+}
+
+// WithStaleWhileRevalidate allows entries of the cache set with
+// WithQueryCache to be served for up to staleTTL after they expire. A stale
+// entry is returned immediately, while it is refreshed in the background,
+// with a context detached from the request. Only one refresh of an entry
+// runs at a time.
+func WithStaleWhileRevalidate(staleTTL time.Duration) Opt {
+	return func(sjc *Handler) error {
+		if staleTTL <= 0 {
+			return errors.New("stale ttl must be positive")
+		}
+		sjc.cacheStaleTTL = staleTTL
+		return nil
+	}
+}
+
+type queryCacheEntry struct {
+	dps        []DataPoint
+	fetched    time.Time
+	refreshing bool
+}
+
+type queryCache struct {
+	sync.Mutex
+	ttl, stale time.Duration
+	timeout    time.Duration
+	logf       func(string, ...interface{})
+	entries    map[string]*queryCacheEntry
+	lastSweep  time.Time
+}
+
+func newQueryCache(h *Handler) *queryCache {
+	return &queryCache{
+		ttl:     h.cacheTTL,
+		stale:   h.cacheStaleTTL,
+		timeout: h.queryTimeout,
+		logf:    h.logf,
+		entries: map[string]*queryCacheEntry{},
+	}
+}
+
+// queryCacheKey identifies the results of querying target with args, on
+// behalf of the Grafana organisation and user in ctx, so that data is never
+// shared between them.
+func queryCacheKey(ctx context.Context, req simpleJSONQuery, target string, args QueryArguments) string {
+	orgID, _ := OrgIDFromContext(ctx)
+	user, _ := UserFromContext(ctx)
+	from, to := req.RangeRaw.From, req.RangeRaw.To
+	if from == "" || to == "" {
+		from, to = args.From.UTC().Format(time.RFC3339Nano), args.To.UTC().Format(time.RFC3339Nano)
+	}
+	loc := ""
+	if args.Location != nil {
+		loc = args.Location.String()
+	}
+	return fmt.Sprintf("%q %q %q %q %q %v %d %q %q %v", orgID, user, target, from, to, args.Interval, args.MaxDPs, args.Downsample, loc, args.Filters)
+}
+
+// get returns the cached datapoints for key, calling fetch if there are
+// none, or they have expired.
+func (c *queryCache) get(ctx context.Context, key string, fetch func(context.Context) ([]DataPoint, error)) ([]DataPoint, error) {
+	now := time.Now()
+
+	c.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		age := now.Sub(e.fetched)
+		switch {
+		case age < c.ttl:
+			dps := append([]DataPoint(nil), e.dps...)
+			c.Unlock()
+			return dps, nil
+		case age < c.ttl+c.stale:
+			if !e.refreshing {
+				e.refreshing = true
+				go c.refresh(detachedContext(ctx), key, e, fetch)
+			}
+			dps := append([]DataPoint(nil), e.dps...)
+			c.Unlock()
+			return dps, nil
+		}
+	}
+	c.Unlock()
+
+	dps, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, dps, now)
+	return append([]DataPoint(nil), dps...), nil
+}
+
+// refresh fetches e in the background.
+func (c *queryCache) refresh(ctx context.Context, key string, e *queryCacheEntry, fetch func(context.Context) ([]DataPoint, error)) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	dps, err := func() (dps []DataPoint, err error) {
+		// The refresh runs outside of the request, so panics must be
+		// recovered here, whether or not WithRecovery is used.
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+		return fetch(ctx)
+	}()
+
+	c.Lock()
+	e.refreshing = false
+	c.Unlock()
+	if err != nil {
+		c.logf("refreshing cached query failed, %v", err)
+		return
+	}
+	c.set(key, dps, start)
+}
+
+func (c *queryCache) set(key string, dps []DataPoint, fetched time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	// Expired entries are swept at most once per ttl.
+	if fetched.Sub(c.lastSweep) > c.ttl {
+		for k, e := range c.entries {
+			if !e.refreshing && fetched.Sub(e.fetched) >= c.ttl+c.stale {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = fetched
+	}
+
+	if e, ok := c.entries[key]; ok {
+		e.dps = dps
+		e.fetched = fetched
+		return
+	}
+	c.entries[key] = &queryCacheEntry{dps: dps, fetched: fetched}
+}
+
+// detachedContext returns a context that is not cancelled along with ctx,
+// but carries the same Grafana organisation and user.
+func detachedContext(ctx context.Context) context.Context {
+	out := context.Background()
+	if orgID, ok := OrgIDFromContext(ctx); ok {
+		out = ContextWithOrgID(out, orgID)
+	}
+	if user, ok := UserFromContext(ctx); ok {
+		out = ContextWithUser(out, user)
+	}
+	return out
+}
@@ -0,0 +1,205 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"sort"
+	"time"
+)
+
+// Config is a snapshot of the effective configuration of a Handler, as
+// returned by Config. Changing it has no effect on the Handler.
+type Config struct {
+	Querier               bool
+	MultiQuerier          bool
+	BandQuerier           bool
+	ForecastQuerier       bool
+	TableQuerier          bool
+	Annotator             bool
+	Searcher              bool
+	SearcherV2            bool
+	StreamingSearcher     bool
+	VariableSearcher      bool
+	TagSearcher           bool
+	VariableResolver      bool
+	MetricPayloadOptioner bool
+
+	RelativeRanges       bool
+	SecondPrecisionRange bool
+	QueryRewriter        bool
+	TargetAuthorizer     bool
+	SearchTransform      bool
+
+	TypedTableCells   bool
+	SortTableByTime   bool
+	DisableHTMLEscape bool
+	ResponseEnvelope  string
+
+	SeriesAscending        bool
+	SortSeriesByLastValue  bool
+	SortSeriesDescending   bool
+	SkipHidden             bool
+	OutputLocation         *time.Location
+	TimeResolution         TimeResolution
+	Downsample             DownsampleMethod
+	InfSentinels           []float64
+	StreamingQueries       bool
+	SyntheticData          bool
+	TargetsHeader          bool
+	RequireJSONContentType bool
+	StrictMethods          bool
+	BatchRequests          bool
+	MaxAdhocFilters        int
+	PartialResults         bool
+
+	QueryCacheTTL        time.Duration
+	StaleWhileRevalidate time.Duration
+
+	AnnotationIsRegion     bool
+	AnnotationRegionMode   AnnotationRegionMode
+	AnnotationTagFilter    bool
+	AnnotationTextTemplate bool
+
+	// AnnotationTagSeparator is set if WithAnnotationTagsAsString has been
+	// used.
+	AnnotationTagSeparator *string
+
+	ErrorLogSize int
+
+	DecodeTimeout          time.Duration
+	QueryTimeout           time.Duration
+	QueryTimeoutFromTarget bool
+
+	GlobalConcurrency        int
+	GlobalConcurrencyTimeout time.Duration
+
+	Profiles []string
+
+	SlowQueryThreshold time.Duration
+
+	HealthCheck     bool
+	Warmup          bool
+	NotFoundHandler bool
+	CORSOrigins     []string
+	Recovery        bool
+	AccessLog       bool
+	Gzip            bool
+	GzipMinSize     int
+	Middleware      int
+	PathPrefix      string
+	MetricsPath     string
+}
+
+// Config returns a snapshot of the handler's effective configuration,
+// intended to allow tests to verify which options have been applied.
+func (h *Handler) Config() Config {
+	cfg := Config{
+		Querier:               h.query != nil,
+		MultiQuerier:          h.multiQuery != nil,
+		BandQuerier:           h.bandQuery != nil,
+		ForecastQuerier:       h.forecastQuery != nil,
+		TableQuerier:          h.tableQuery != nil,
+		Annotator:             h.annotations != nil,
+		Searcher:              h.search != nil,
+		SearcherV2:            h.searchV2 != nil,
+		StreamingSearcher:     h.searchStream != nil,
+		VariableSearcher:      h.variableSearch != nil,
+		TagSearcher:           h.tags != nil,
+		VariableResolver:      h.variables != nil,
+		MetricPayloadOptioner: h.metricPayloadOptions != nil,
+
+		RelativeRanges:       h.now != nil,
+		SecondPrecisionRange: h.secondPrecisionRange,
+		QueryRewriter:        h.queryRewriter != nil,
+		TargetAuthorizer:     h.targetAuthorizer != nil,
+		SearchTransform:      h.searchTransform != nil,
+
+		TypedTableCells:   h.typedTableCells,
+		SortTableByTime:   h.sortTableByTime,
+		DisableHTMLEscape: h.noHTMLEscape,
+		ResponseEnvelope:  h.envelope,
+
+		SeriesAscending:        !h.seriesDescending,
+		SortSeriesByLastValue:  h.sortSeriesByLast,
+		SortSeriesDescending:   h.sortSeriesDesc,
+		SkipHidden:             h.skipHidden,
+		OutputLocation:         h.outputLocation,
+		TimeResolution:         h.timeResolution,
+		Downsample:             h.downsample,
+		StreamingQueries:       h.streamQueries,
+		SyntheticData:          h.synthetic,
+		TargetsHeader:          h.targetsHeader,
+		RequireJSONContentType: h.requireJSON,
+		StrictMethods:          h.strictMethods,
+		BatchRequests:          h.batchRequests,
+		MaxAdhocFilters:        h.maxAdhocFilters,
+		PartialResults:         h.partialResults,
+
+		QueryCacheTTL:        h.cacheTTL,
+		StaleWhileRevalidate: h.cacheStaleTTL,
+
+		AnnotationIsRegion:     h.annotationIsRegion,
+		AnnotationRegionMode:   h.annotationRegionMode,
+		AnnotationTagFilter:    h.annotationTagFilter,
+		AnnotationTextTemplate: h.annotationText != nil,
+
+		DecodeTimeout:          h.decodeTimeout,
+		QueryTimeout:           h.queryTimeout,
+		QueryTimeoutFromTarget: h.queryTimeoutFromTarget,
+
+		GlobalConcurrency:        cap(h.backendSem),
+		GlobalConcurrencyTimeout: h.backendSemTimeout,
+
+		SlowQueryThreshold: h.slowQueryThreshold,
+
+		HealthCheck:     h.healthCheck != nil,
+		Warmup:          h.warmup != nil,
+		NotFoundHandler: h.notFound != nil,
+		Recovery:        h.recovery,
+		AccessLog:       h.accessLog != nil,
+		Gzip:            h.gzip,
+		GzipMinSize:     h.gzipMinSize,
+		Middleware:      len(h.middleware),
+		PathPrefix:      h.pathPrefix,
+	}
+
+	if h.infSentinels {
+		cfg.InfSentinels = []float64{h.posInf, h.negInf}
+	}
+
+	if h.telemetry != nil {
+		cfg.MetricsPath = h.telemetry.path
+	}
+
+	if h.annotationTagSep != nil {
+		sep := *h.annotationTagSep
+		cfg.AnnotationTagSeparator = &sep
+	}
+
+	if h.errorLog != nil {
+		cfg.ErrorLogSize = cap(h.errorLog.entries)
+	}
+
+	for name := range h.profiles {
+		cfg.Profiles = append(cfg.Profiles, name)
+	}
+	sort.Strings(cfg.Profiles)
+
+	for origin := range h.corsOrigins {
+		cfg.CORSOrigins = append(cfg.CORSOrigins, origin)
+	}
+	sort.Strings(cfg.CORSOrigins)
+
+	return cfg
+}
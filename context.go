@@ -0,0 +1,82 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"net/http"
+)
+
+// The headers Grafana uses to identify the organisation and user a
+// datasource request is made on behalf of. Grafana only sends the user
+// header if send_user_header is enabled in its dataproxy configuration.
+const (
+	GrafanaOrgIDHeader = "X-Grafana-Org-Id"
+	GrafanaUserHeader  = "X-Grafana-User"
+)
+
+type contextKey int
+
+const (
+	orgIDKey contextKey = iota
+	userKey
+)
+
+// ContextWithOrgID returns a copy of ctx carrying a Grafana organisation
+// ID. The Handler does this for each request that includes the
+// GrafanaOrgIDHeader header.
+func ContextWithOrgID(ctx context.Context, orgID string) context.Context {
+	return context.WithValue(ctx, orgIDKey, orgID)
+}
+
+// OrgIDFromContext returns the Grafana organisation ID the request was made
+// on behalf of, if known. Data sources can use it, for instance, to return
+// tenant specific tag keys.
+func OrgIDFromContext(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(orgIDKey).(string)
+	return v, ok
+}
+
+// ContextWithUser returns a copy of ctx carrying a Grafana user login. The
+// Handler does this for each request that includes the GrafanaUserHeader
+// header.
+func ContextWithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// UserFromContext returns the login of the Grafana user the request was
+// made on behalf of, if known.
+func UserFromContext(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(userKey).(string)
+	return v, ok
+}
+
+// withIdentity adds the Grafana organisation and user from the request
+// headers to the request's context.
+func withIdentity(r *http.Request) *http.Request {
+	orgID := r.Header.Get(GrafanaOrgIDHeader)
+	user := r.Header.Get(GrafanaUserHeader)
+	if orgID == "" && user == "" {
+		return r
+	}
+
+	ctx := r.Context()
+	if orgID != "" {
+		ctx = ContextWithOrgID(ctx, orgID)
+	}
+	if user != "" {
+		ctx = ContextWithUser(ctx, user)
+	}
+	return r.WithContext(ctx)
+}
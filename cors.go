@@ -0,0 +1,57 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import "net/http"
+
+// WithCORS allows browsers on the given origins to call all endpoints. CORS
+// headers are added to responses for requests from those origins, and
+// OPTIONS preflight requests are answered directly. An origin of "*" allows
+// any origin. With no origins, CORS is not enabled.
+func WithCORS(origins ...string) Opt {
+	return func(sjc *Handler) error {
+		if len(origins) == 0 {
+			return nil
+		}
+		sjc.corsOrigins = map[string]bool{}
+		for _, o := range origins {
+			sjc.corsOrigins[o] = true
+		}
+		return nil
+	}
+}
+
+// handleCORS adds CORS headers for allowed origins, and returns true if the
+// request was a preflight that has been answered.
+func (h *Handler) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if h.corsOrigins == nil || origin == "" {
+		return false
+	}
+	if !h.corsOrigins[origin] && !h.corsOrigins["*"] {
+		return false
+	}
+
+	hdr := w.Header()
+	hdr.Set("Access-Control-Allow-Origin", origin)
+	hdr.Add("Vary", "Origin")
+	hdr.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	hdr.Set("Access-Control-Allow-Headers", "Accept, Content-Type, Authorization")
+
+	if r.Method != http.MethodOptions {
+		return false
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithErrorLog keeps a record of the last n errors returned to clients, and
+// serves them, oldest first, as JSON from /debug/errors.
+func WithErrorLog(n int) Opt {
+	return func(sjc *Handler) error {
+		if n <= 0 {
+			return errors.New("error log size must be positive")
+		}
+		sjc.errorLog = &errorLog{entries: make([]errorLogEntry, 0, n)}
+		return nil
+	}
+}
+
+type errorLogEntry struct {
+	Time     simpleJSONTime `json:"time"`
+	Endpoint string         `json:"endpoint"`
+	Message  string         `json:"message"`
+}
+
+// errorLog is a bounded ring buffer of recent errors.
+type errorLog struct {
+	sync.Mutex
+	next    int
+	entries []errorLogEntry
+}
+
+func (l *errorLog) record(endpoint string, err error) {
+	e := errorLogEntry{
+		Time:     simpleJSONTime(time.Now()),
+		Endpoint: endpoint,
+		Message:  err.Error(),
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, e)
+		return
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+func (l *errorLog) list() []errorLogEntry {
+	l.Lock()
+	defer l.Unlock()
+	out := make([]errorLogEntry, 0, len(l.entries))
+	out = append(out, l.entries[l.next:]...)
+	out = append(out, l.entries[:l.next]...)
+	return out
+}
+
+// HandleDebugErrors serves the recent errors recorded by WithErrorLog.
+func (h *Handler) HandleDebugErrors(w http.ResponseWriter, r *http.Request) {
+	if h.errorLog == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	bs, err := json.Marshal(h.errorLog.list())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"fmt"
+)
+
+// DownsampleMethod selects how datapoints are combined when a series is
+// downsampled.
+type DownsampleMethod string
+
+// The supported downsampling methods.
+const (
+	DownsampleAvg   DownsampleMethod = "avg"
+	DownsampleMin   DownsampleMethod = "min"
+	DownsampleMax   DownsampleMethod = "max"
+	DownsampleSum   DownsampleMethod = "sum"
+	DownsampleFirst DownsampleMethod = "first"
+	DownsampleLast  DownsampleMethod = "last"
+)
+
+// WithDownsampling causes timeserie responses with more datapoints than the
+// request's maxDataPoints to be downsampled. Each target may select the
+// method with a "downsample" field in its data payload, e.g.
+// {"target": "a", "data": {"downsample": "max"}}, otherwise def is used.
+func WithDownsampling(def DownsampleMethod) Opt {
+	return func(sjc *Handler) error {
+		if _, err := downsampleAggregation(def); err != nil {
+			return err
+		}
+		sjc.downsample = def
+		return nil
+	}
+}
+
+func downsampleAggregation(m DownsampleMethod) (Aggregation, error) {
+	switch m {
+	case DownsampleAvg:
+		return AggregateAvg, nil
+	case DownsampleMin:
+		return AggregateMin, nil
+	case DownsampleMax:
+		return AggregateMax, nil
+	case DownsampleSum:
+		return AggregateSum, nil
+	case DownsampleFirst:
+		return AggregateFirst, nil
+	case DownsampleLast:
+		return AggregateLast, nil
+	default:
+		return nil, fmt.Errorf("unknown downsample method %q", m)
+	}
+}
+
+// downsample reduces dps, which must be sorted by time, to at most n
+// datapoints using method, as Downsample does.
+func downsample(dps []DataPoint, n int, method DownsampleMethod) ([]DataPoint, error) {
+	agg, err := downsampleAggregation(method)
+	if err != nil {
+		return nil, err
+	}
+	return Downsample(dps, n, agg), nil
+}
+
+// Downsample reduces points, which must be sorted by time, to at most
+// maxDPs datapoints. The time spanned by the points is divided into maxDPs
+// equal buckets, and the values in each bucket are combined with agg. Each
+// resulting point takes the time of the first point in its bucket, and
+// empty buckets are omitted. Null points are not aggregated; a bucket
+// holding only null points results in a null point. If maxDPs is not
+// positive, or there are no more points than maxDPs, points is returned as
+// is.
+func Downsample(points []DataPoint, maxDPs int, agg Aggregation) []DataPoint {
+	if maxDPs <= 0 || len(points) <= maxDPs {
+		return points
+	}
+
+	first := points[0].Time
+	span := float64(points[len(points)-1].Time.Sub(first))
+	bucket := func(dp DataPoint) int {
+		if span <= 0 {
+			return 0
+		}
+		b := int(float64(dp.Time.Sub(first)) / span * float64(maxDPs))
+		if b >= maxDPs {
+			b = maxDPs - 1
+		}
+		return b
+	}
+
+	out := make([]DataPoint, 0, maxDPs)
+	var vs []float64
+	start := 0
+	for i := 1; i <= len(points); i++ {
+		if i < len(points) && bucket(points[i]) == bucket(points[start]) {
+			continue
+		}
+		vs = vs[:0]
+		for _, dp := range points[start:i] {
+			if !dp.Null {
+				vs = append(vs, dp.Value)
+			}
+		}
+		if len(vs) == 0 {
+			out = append(out, NullDataPoint(points[start].Time))
+		} else {
+			out = append(out, DataPoint{Time: points[start].Time, Value: agg(vs)})
+		}
+		start = i
+	}
+	return out
+}
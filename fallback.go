@@ -0,0 +1,40 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import "context"
+
+type fallbackQuerier struct {
+	primary, fallback Querier
+	shouldFallback    func(error) bool
+}
+
+// FallbackQuerier returns a Querier that queries primary, and if that fails
+// with an error for which shouldFallback returns true, queries fallback
+// instead. If shouldFallback is nil any error causes the fallback to be
+// used. The fallback is not tried once the context is done.
+func FallbackQuerier(primary, fallback Querier, shouldFallback func(error) bool) Querier {
+	return fallbackQuerier{primary: primary, fallback: fallback, shouldFallback: shouldFallback}
+}
+
+func (q fallbackQuerier) GrafanaQuery(ctx context.Context, target string, args QueryArguments) ([]DataPoint, error) {
+	dps, err := q.primary.GrafanaQuery(ctx, target, args)
+	if err == nil || ctx.Err() != nil {
+		return dps, err
+	}
+	if q.shouldFallback != nil && !q.shouldFallback(err) {
+		return nil, err
+	}
+	return q.fallback.GrafanaQuery(ctx, target, args)
+}
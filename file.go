@@ -0,0 +1,205 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileFormat is the format of a file read by a FileQuerier.
+type FileFormat int
+
+// The supported file formats.
+//
+// FileFormatJSON files hold an array of series in the same form as a
+// timeserie query response:
+//
+//	[{"target": "cpu", "datapoints": [[1.5, 1477893600000], [null, 1477897200000]]}]
+//
+// FileFormatCSV files have a header row naming the time column, followed
+// by one column per target. Times may be RFC3339 or epoch milliseconds.
+// Empty cells are skipped, and "null" cells are sent as nulls:
+//
+//	time,cpu,mem
+//	2016-10-31T06:00:00Z,1.5,100
+//	1477897200000,null,
+const (
+	FileFormatJSON FileFormat = iota
+	FileFormatCSV
+)
+
+// FileQuerier is a Querier and Searcher that serves series loaded from a
+// file, intended for demos, offline dashboards and tests.
+type FileQuerier struct {
+	series  map[string][]DataPoint
+	targets []string
+}
+
+// NewFileQuerier loads the file at path, which must have a .json or .csv
+// extension.
+func NewFileQuerier(path string) (*FileQuerier, error) {
+	var format FileFormat
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		format = FileFormatJSON
+	case ".csv":
+		format = FileFormatCSV
+	default:
+		return nil, fmt.Errorf("unknown file format %q", ext)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fq, err := ReadFileQuerier(f, format)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s, %w", path, err)
+	}
+	return fq, nil
+}
+
+// ReadFileQuerier reads series in the given format from r.
+func ReadFileQuerier(r io.Reader, format FileFormat) (*FileQuerier, error) {
+	fq := &FileQuerier{series: map[string][]DataPoint{}}
+
+	var err error
+	switch format {
+	case FileFormatJSON:
+		err = fq.readJSON(r)
+	case FileFormatCSV:
+		err = fq.readCSV(r)
+	default:
+		err = fmt.Errorf("unknown file format %d", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for target, dps := range fq.series {
+		sort.SliceStable(dps, func(i, j int) bool { return dps[i].Time.Before(dps[j].Time) })
+		fq.targets = append(fq.targets, target)
+	}
+	sort.Strings(fq.targets)
+	return fq, nil
+}
+
+func (fq *FileQuerier) readJSON(r io.Reader) error {
+	var series []struct {
+		Target     string       `json:"target"`
+		DataPoints [][]*float64 `json:"datapoints"`
+	}
+	if err := json.NewDecoder(r).Decode(&series); err != nil {
+		return err
+	}
+
+	for _, s := range series {
+		dps := fq.series[s.Target]
+		for _, dp := range s.DataPoints {
+			if len(dp) != 2 || dp[1] == nil {
+				return fmt.Errorf("invalid datapoint for target %q, expected [value, time]", s.Target)
+			}
+			t := time.Unix(0, int64(*dp[1])*int64(time.Millisecond)).UTC()
+			if dp[0] == nil {
+				dps = append(dps, NullDataPoint(t))
+				continue
+			}
+			dps = append(dps, DataPoint{Time: t, Value: *dp[0]})
+		}
+		fq.series[s.Target] = dps
+	}
+	return nil
+}
+
+func (fq *FileQuerier) readCSV(r io.Reader) error {
+	recs, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 || len(recs[0]) < 2 {
+		return fmt.Errorf("expected a header row with a time column and at least one target")
+	}
+
+	targets := recs[0][1:]
+	for i, rec := range recs[1:] {
+		line := i + 2
+		t, err := parseFileTime(rec[0])
+		if err != nil {
+			return fmt.Errorf("line %d, %w", line, err)
+		}
+		for j, cell := range rec[1:] {
+			switch cell = strings.TrimSpace(cell); cell {
+			case "":
+			case "null":
+				fq.series[targets[j]] = append(fq.series[targets[j]], NullDataPoint(t))
+			default:
+				v, err := strconv.ParseFloat(cell, 64)
+				if err != nil {
+					return fmt.Errorf("line %d, %w", line, err)
+				}
+				fq.series[targets[j]] = append(fq.series[targets[j]], DataPoint{Time: t, Value: v})
+			}
+		}
+	}
+	return nil
+}
+
+// parseFileTime parses an RFC3339 time, or epoch milliseconds.
+func parseFileTime(str string) (time.Time, error) {
+	str = strings.TrimSpace(str)
+	if ms, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, str)
+}
+
+// GrafanaQuery returns the datapoints of target within the query range.
+func (fq *FileQuerier) GrafanaQuery(ctx context.Context, target string, args QueryArguments) ([]DataPoint, error) {
+	dps, ok := fq.series[target]
+	if !ok {
+		return nil, fmt.Errorf("unknown target %q", target)
+	}
+
+	var out []DataPoint
+	for _, dp := range dps {
+		if dp.Time.Before(args.From) || dp.Time.After(args.To) {
+			continue
+		}
+		out = append(out, dp)
+	}
+	return out, nil
+}
+
+// GrafanaSearch returns the targets in the file that contain target.
+func (fq *FileQuerier) GrafanaSearch(ctx context.Context, target string) ([]string, error) {
+	out := []string{}
+	for _, t := range fq.targets {
+		if strings.Contains(t, target) {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
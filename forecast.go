@@ -0,0 +1,101 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// ForecastPoint is a predicted value, with the bounds of its confidence
+// interval, at a point in time.
+type ForecastPoint struct {
+	Time                   time.Time
+	Estimate, Lower, Upper float64
+}
+
+// ForecastSeries is a series of predictions. Confidence is the confidence
+// level of the intervals, e.g. 0.95, and is omitted if zero.
+type ForecastSeries struct {
+	Confidence float64
+	Points     []ForecastPoint
+}
+
+// A ForecastQuerier responds to queries for targets of type "forecast",
+// e.g. {"target": "sales", "type": "forecast"}. Each point is sent as an
+// object, {"time": 1000, "yhat": 2, "yhat_lower": 1, "yhat_upper": 3}, and
+// the series is marked with "type": "forecast".
+type ForecastQuerier interface {
+	GrafanaForecastQuery(ctx context.Context, target string, args QueryArguments) (ForecastSeries, error)
+}
+
+// WithForecastQuerier adds a handler for "forecast" queries.
+func WithForecastQuerier(q ForecastQuerier) Opt {
+	return func(sjc *Handler) error {
+		sjc.forecastQuery = q
+		return nil
+	}
+}
+
+type simpleJSONForecastPoint struct {
+	Time     simpleJSONPointTime `json:"time"`
+	Estimate simpleJSONValue     `json:"yhat"`
+	Lower    simpleJSONValue     `json:"yhat_lower"`
+	Upper    simpleJSONValue     `json:"yhat_upper"`
+}
+
+type simpleJSONForecastData struct {
+	Target     string                    `json:"target"`
+	Type       string                    `json:"type"`
+	Confidence float64                   `json:"confidence,omitempty"`
+	DataPoints []simpleJSONForecastPoint `json:"datapoints"`
+}
+
+func (h *Handler) jsonForecastQuery(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) (interface{}, error) {
+	args := req.queryArguments(target)
+	release, err := h.acquireBackend(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.forecastQuery.GrafanaForecastQuery(ctx, target.Target, args)
+	release()
+	if err != nil {
+		return nil, err
+	}
+
+	points := resp.Points
+	sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	if h.seriesDescending {
+		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+			points[i], points[j] = points[j], points[i]
+		}
+	}
+
+	out := simpleJSONForecastData{
+		Target:     target.Target,
+		Type:       "forecast",
+		Confidence: resp.Confidence,
+		DataPoints: []simpleJSONForecastPoint{},
+	}
+	for _, p := range points {
+		out.DataPoints = append(out.DataPoints, simpleJSONForecastPoint{
+			Time:     h.pointTime(p.Time),
+			Estimate: simpleJSONValue(h.replaceInf(p.Estimate)),
+			Lower:    simpleJSONValue(h.replaceInf(p.Lower)),
+			Upper:    simpleJSONValue(h.replaceInf(p.Upper)),
+		})
+	}
+	return out, nil
+}
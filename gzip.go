@@ -0,0 +1,186 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WithGzip compresses responses with gzip for clients that send
+// Accept-Encoding: gzip. Responses smaller than minSize bytes are sent
+// uncompressed, as compressing them gains little.
+func WithGzip(minSize int) Opt {
+	return func(sjc *Handler) error {
+		if minSize < 0 {
+			return fmt.Errorf("gzip minimum size must not be negative, got %d", minSize)
+		}
+		sjc.gzip = true
+		sjc.gzipMinSize = minSize
+		return nil
+	}
+}
+
+// GzipMiddleware returns middleware that compresses responses in the same
+// way as WithGzip, for use with WithMiddleware, or any other http.Handler,
+// where the compression must be ordered relative to other middleware.
+func GzipMiddleware(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w, done := gzipResponse(w, r, minSize)
+			defer done()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// gzipResponse wraps w to compress the response, if the client accepts
+// gzip and the response is not already being compressed. The returned
+// function must be called once the response is complete.
+func gzipResponse(w http.ResponseWriter, r *http.Request, minSize int) (http.ResponseWriter, func() error) {
+	if _, ok := w.(*gzipWriter); ok {
+		return w, func() error { return nil }
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return w, func() error { return nil }
+	}
+	gw := &gzipWriter{ResponseWriter: w, minSize: minSize}
+	return gw, gw.Close
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding header allows
+// a gzip encoded response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter buffers the start of a response until it has at least minSize
+// bytes, or is flushed, and then writes the rest gzip compressed. Smaller
+// responses are written as is when the writer is closed.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	started bool
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.started || w.status != 0 {
+		return
+	}
+	w.status = code
+}
+
+func (w *gzipWriter) Write(bs []byte) (int, error) {
+	if !w.started {
+		w.buf = append(w.buf, bs...)
+		if len(w.buf) < w.minSize {
+			return len(bs), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(bs), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(bs)
+	}
+	return w.ResponseWriter.Write(bs)
+}
+
+// start writes the headers, and anything buffered so far, switching to
+// compressed output if compress is set.
+func (w *gzipWriter) start(compress bool) error {
+	w.started = true
+	hdr := w.ResponseWriter.Header()
+	if compress && hdr.Get("Content-Encoding") == "" {
+		if hdr.Get("Content-Type") == "" {
+			hdr.Set("Content-Type", http.DetectContentType(w.buf))
+		}
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush implements http.Flusher. Flushing a response commits it to being
+// compressed, as streamed responses are usually large.
+func (w *gzipWriter) Flush() {
+	if !w.started {
+		w.start(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close writes any buffered response, and completes the gzip stream.
+func (w *gzipWriter) Close() error {
+	if !w.started {
+		if err := w.start(false); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// WithGlobalConcurrency limits the number of simultaneous calls to the
+// Querier, TableQuerier and Annotator across all requests to n. Calls
+// beyond the limit wait for a slot, see WithGlobalConcurrencyTimeout.
+func WithGlobalConcurrency(n int) Opt {
+	return func(sjc *Handler) error {
+		if n <= 0 {
+			return errors.New("global concurrency must be positive")
+		}
+		sjc.backendSem = make(chan struct{}, n)
+		return nil
+	}
+}
+
+// WithGlobalConcurrencyTimeout sets how long a call waits for a slot when
+// the limit set by WithGlobalConcurrency is reached. Requests that time out
+// fail with 503 Service Unavailable. By default calls wait until the
+// request is cancelled.
+func WithGlobalConcurrencyTimeout(d time.Duration) Opt {
+	return func(sjc *Handler) error {
+		sjc.backendSemTimeout = d
+		return nil
+	}
+}
+
+// acquireBackend waits for a slot to call the backend, returning a function
+// to release it.
+func (h *Handler) acquireBackend(ctx context.Context) (func(), error) {
+	if h.backendSem == nil {
+		return func() {}, nil
+	}
+
+	var timeout <-chan time.Time
+	if h.backendSemTimeout > 0 {
+		t := time.NewTimer(h.backendSemTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case h.backendSem <- struct{}{}:
+		return func() { <-h.backendSem }, nil
+	case <-timeout:
+		return nil, &StatusError{
+			Code: http.StatusServiceUnavailable,
+			Err:  errors.New("too many concurrent backend requests"),
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
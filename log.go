@@ -0,0 +1,72 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import "time"
+
+// A Logger is used by the Handler to log messages. *log.Logger satisfies
+// this interface.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// WithLogger sets the Logger used by the Handler. By default nothing is
+// logged. When a Logger is set, the requests served, with their targets and
+// time ranges, any errors returned to clients, such as decode failures and
+// data source errors, and other messages, such as slow queries and
+// recovered panics, are logged.
+func WithLogger(l Logger) Opt {
+	return func(sjc *Handler) error {
+		sjc.logger = l
+		return nil
+	}
+}
+
+// WithSlowQueryLog logs any query, annotation or search request that takes
+// longer than threshold, along with its target and duration, to the Logger
+// set with WithLogger.
+func WithSlowQueryLog(threshold time.Duration) Opt {
+	return func(sjc *Handler) error {
+		sjc.slowQueryThreshold = threshold
+		return nil
+	}
+}
+
+// logf logs only if a Logger has been set with WithLogger.
+func (h *Handler) logf(format string, v ...interface{}) {
+	if h.logger == nil {
+		return
+	}
+	h.logger.Printf(format, v...)
+}
+
+// logRequestf logs only if a Logger has been set with WithLogger, so that
+// per-request logging is off by default.
+func (h *Handler) logRequestf(format string, v ...interface{}) {
+	if h.logger == nil {
+		return
+	}
+	h.logger.Printf(format, v...)
+}
+
+// logSlow logs the request if it has taken longer than the threshold set with
+// WithSlowQueryLog. It is intended to be deferred.
+func (h *Handler) logSlow(start time.Time, endpoint, target string) {
+	if h.slowQueryThreshold <= 0 {
+		return
+	}
+	if d := time.Since(start); d > h.slowQueryThreshold {
+		h.logf("slow query, endpoint: %s, target: %q, duration: %v", endpoint, target, d)
+	}
+}
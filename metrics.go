@@ -0,0 +1,111 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// WithMetricPayloadOptioner adds a handler for the /metric-payload-options
+// endpoint.
+func WithMetricPayloadOptioner(mp MetricPayloadOptioner) Opt {
+	return func(sjc *Handler) error {
+		sjc.metricPayloadOptions = mp
+		return nil
+	}
+}
+
+// MetricPayloadOptionsArguments describes a request for the options of a
+// metric's payload field. Metric is the selected metric, Name the payload
+// field whose options are wanted, and Payload holds the raw payload values
+// selected so far, allowing cascading options.
+type MetricPayloadOptionsArguments struct {
+	Metric  string
+	Name    string
+	Payload json.RawMessage
+}
+
+// MetricPayloadOption is a single option of a metric's payload field.
+type MetricPayloadOption struct {
+	Label string
+	Value string
+}
+
+// A MetricPayloadOptioner responds to requests for the options of metric
+// payload fields, used by query editors that select a metric and then
+// refine it with further fields.
+type MetricPayloadOptioner interface {
+	GrafanaMetricPayloadOptions(ctx context.Context, args MetricPayloadOptionsArguments) ([]MetricPayloadOption, error)
+}
+
+type simpleJSONMetricPayloadOptionsQuery struct {
+	Metric  string          `json:"metric"`
+	Name    string          `json:"name"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type simpleJSONMetricPayloadOption struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// HandleMetricPayloadOptions implements the /metric-payload-options
+// endpoint. The request names the metric, the payload field whose options
+// are wanted, and the payload selected so far:
+//
+//	{"metric": "cpu", "name": "host", "payload": {"dc": "eu"}}
+//
+// The response is a list of options:
+//
+//	[{"label": "web 1", "value": "web1"}]
+func (h *Handler) HandleMetricPayloadOptions(w http.ResponseWriter, r *http.Request) {
+	if h.metricPayloadOptions == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	req := simpleJSONMetricPayloadOptionsQuery{}
+	if err := h.decodeRequest(w, r, &req); err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	defer h.logSlow(time.Now(), "/metric-payload-options", req.Metric)
+
+	opts, err := h.metricPayloadOptions.GrafanaMetricPayloadOptions(r.Context(), MetricPayloadOptionsArguments{
+		Metric:  req.Metric,
+		Name:    req.Name,
+		Payload: req.Payload,
+	})
+	if err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	out := []simpleJSONMetricPayloadOption{}
+	for _, o := range opts {
+		out = append(out, simpleJSONMetricPayloadOption{Label: o.Label, Value: o.Value})
+	}
+
+	bs, err := h.marshal(out)
+	if err != nil {
+		h.writeError(w, r, err, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
@@ -0,0 +1,51 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// WithRecovery recovers panics in any endpoint, such as those raised by a
+// Querier, logs them with a stack trace, and responds with a 500. If hook
+// is not nil it is called with the request and the recovered value.
+func WithRecovery(hook func(r *http.Request, v interface{})) Opt {
+	return func(sjc *Handler) error {
+		sjc.recovery = true
+		sjc.panicHook = hook
+		return nil
+	}
+}
+
+// recoverPanic is deferred by ServeHTTP if WithRecovery has been used.
+func (h *Handler) recoverPanic(w http.ResponseWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+
+	h.logf("panic serving %s, %v\n%s", r.URL.Path, v, debug.Stack())
+	if h.errorLog != nil {
+		h.errorLog.record(r.URL.Path, fmt.Errorf("panic: %v", v))
+	}
+	if h.panicHook != nil {
+		h.panicHook(r, v)
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRelativeTime parses a Grafana style relative time expression such as
+// "now", "now-6h", "now/d" or "now-1d/d". Supported units are s, m, h, d,
+// w, M and y. Rounding with /unit truncates to the start of the unit, or to
+// the last millisecond of the unit if roundUp is set (as Grafana does for the
+// end of a range). Weeks start on Monday.
+func parseRelativeTime(expr string, now time.Time, roundUp bool) (time.Time, error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "now") {
+		return time.Time{}, fmt.Errorf("invalid relative time %q", expr)
+	}
+
+	t := now
+	rest := expr[len("now"):]
+	for len(rest) > 0 {
+		op := rest[0]
+		rest = rest[1:]
+		switch op {
+		case '+', '-':
+			i := 0
+			for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+				i++
+			}
+			n := 1
+			if i > 0 {
+				n, _ = strconv.Atoi(rest[:i])
+			}
+			if i >= len(rest) {
+				return time.Time{}, fmt.Errorf("missing unit in relative time %q", expr)
+			}
+			if op == '-' {
+				n = -n
+			}
+			var err error
+			t, err = addRelativeUnit(t, n, rest[i])
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid relative time %q, %v", expr, err)
+			}
+			rest = rest[i+1:]
+		case '/':
+			if len(rest) == 0 {
+				return time.Time{}, fmt.Errorf("missing unit in relative time %q", expr)
+			}
+			var err error
+			t, err = roundRelativeUnit(t, rest[0], roundUp)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid relative time %q, %v", expr, err)
+			}
+			rest = rest[1:]
+		default:
+			return time.Time{}, fmt.Errorf("invalid relative time %q", expr)
+		}
+	}
+
+	return t, nil
+}
+
+func addRelativeUnit(t time.Time, n int, unit byte) (time.Time, error) {
+	switch unit {
+	case 's':
+		return t.Add(time.Duration(n) * time.Second), nil
+	case 'm':
+		return t.Add(time.Duration(n) * time.Minute), nil
+	case 'h':
+		return t.Add(time.Duration(n) * time.Hour), nil
+	case 'd':
+		return t.AddDate(0, 0, n), nil
+	case 'w':
+		return t.AddDate(0, 0, 7*n), nil
+	case 'M':
+		return t.AddDate(0, n, 0), nil
+	case 'y':
+		return t.AddDate(n, 0, 0), nil
+	default:
+		return time.Time{}, fmt.Errorf("unknown unit %q", unit)
+	}
+}
+
+func roundRelativeUnit(t time.Time, unit byte, roundUp bool) (time.Time, error) {
+	var start, end time.Time
+	y, mo, d := t.Date()
+	loc := t.Location()
+	switch unit {
+	case 's':
+		start = t.Truncate(time.Second)
+		end = start.Add(time.Second)
+	case 'm':
+		start = time.Date(y, mo, d, t.Hour(), t.Minute(), 0, 0, loc)
+		end = start.Add(time.Minute)
+	case 'h':
+		start = time.Date(y, mo, d, t.Hour(), 0, 0, 0, loc)
+		end = start.Add(time.Hour)
+	case 'd':
+		start = time.Date(y, mo, d, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 0, 1)
+	case 'w':
+		offset := (int(t.Weekday()) + 6) % 7
+		start = time.Date(y, mo, d-offset, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 0, 7)
+	case 'M':
+		start = time.Date(y, mo, 1, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 1, 0)
+	case 'y':
+		start = time.Date(y, time.January, 1, 0, 0, 0, 0, loc)
+		end = start.AddDate(1, 0, 0)
+	default:
+		return time.Time{}, fmt.Errorf("unknown unit %q", unit)
+	}
+
+	if roundUp {
+		return end.Add(-time.Millisecond), nil
+	}
+	return start, nil
+}
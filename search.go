@@ -0,0 +1,123 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// SearchArguments defines the options to a search query, beyond its
+// target. Type and Payload hold the "type" and "payload" fields of the
+// request, if sent, e.g.
+//
+//	{"target": "upper", "type": "metrics", "payload": {"namespace": "web"}}
+type SearchArguments struct {
+	Type    string
+	Payload json.RawMessage
+}
+
+// An ArgumentSearcher is a Searcher that is also passed the type and
+// payload of search requests. If the Searcher given to WithSearcher
+// implements it, GrafanaSearchArguments is called in place of
+// GrafanaSearch.
+type ArgumentSearcher interface {
+	Searcher
+	GrafanaSearchArguments(ctx context.Context, target string, args SearchArguments) ([]string, error)
+}
+
+// A StreamingSearcher responds to search queries from Grafana by passing
+// each result to emit, rather than returning a slice, so that very large
+// catalogs need not be held in memory. If emit returns an error, the
+// search should stop and return it.
+type StreamingSearcher interface {
+	GrafanaSearchStream(ctx context.Context, target string, emit func(string) error) error
+}
+
+// A VariableSearcher supplies the values of template variables, which
+// Grafana requests from /search just as it does metric name suggestions.
+// Search requests that name a variable, such as
+//
+//	{"target": "hosts.*", "variable": "host"}
+//
+// are passed to GrafanaVariableValues, with the variable's name and the
+// target as its payload, rather than to the Searcher.
+type VariableSearcher interface {
+	GrafanaVariableValues(ctx context.Context, name, payload string) ([]string, error)
+}
+
+// WithVariableSearcher adds a handler for search requests for the values
+// of template variables.
+func WithVariableSearcher(vs VariableSearcher) Opt {
+	return func(sjc *Handler) error {
+		sjc.variableSearch = vs
+		return nil
+	}
+}
+
+// WithStreamingSearcher adds a streaming search handler. It is used in
+// preference to a Searcher for requests that do not ask for grouped
+// results.
+func WithStreamingSearcher(s StreamingSearcher) Opt {
+	return func(sjc *Handler) error {
+		sjc.searchStream = s
+		return nil
+	}
+}
+
+// streamSearch writes each search result to the response as it is emitted.
+func (h *Handler) streamSearch(w http.ResponseWriter, r *http.Request, req simpleJSONSearchQuery) {
+	flusher, _ := w.(http.Flusher)
+
+	started := false
+	err := h.searchStream.GrafanaSearchStream(r.Context(), req.Target, func(s string) error {
+		bs, err := h.encode(h.searchText(s))
+		if err != nil {
+			return err
+		}
+		if !started {
+			w.Header().Set("Content-Type", "application/json")
+			h.writeStreamOpen(w)
+			started = true
+		} else {
+			w.Write([]byte(","))
+		}
+		_, err = w.Write(bs)
+		return err
+	})
+	if err != nil {
+		if !started {
+			h.writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if h.errorLog != nil {
+			h.errorLog.record(r.URL.Path, err)
+		}
+		h.logf("aborted streamed response to %s, %v", r.URL.Path, err)
+		return
+	}
+
+	if !started {
+		w.Header().Set("Content-Type", "application/json")
+		h.writeStreamOpen(w)
+	}
+	w.Write([]byte("]"))
+	if h.envelope != "" {
+		w.Write([]byte("}"))
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
@@ -18,22 +18,116 @@
 package simplejson
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 )
 
 // Handler Is an opaque type that supports the required HTTP handlers for the
-// Simple JSON plugin
+// Simple JSON plugin. Responses are deterministic: identical results from
+// the data source always marshal to identical bytes, with fields in a fixed
+// order and map keys, such as datapoint labels, sorted, so responses may be
+// safely hashed for caching or ETags.
 type Handler struct {
-	query       Querier
-	tableQuery  TableQuerier
-	annotations Annotator
-	search      Searcher
-	tags        TagSearcher
+	query         Querier
+	multiQuery    MultiQuerier
+	bandQuery     BandQuerier
+	forecastQuery ForecastQuerier
+	tableQuery    TableQuerier
+	annotations   Annotator
+	search        Searcher
+	searchV2      SearcherV2
+	searchStream  StreamingSearcher
+	tags          TagSearcher
+
+	variableSearch VariableSearcher
+	variables      VariableResolver
+
+	metricPayloadOptions MetricPayloadOptioner
+
+	now                  func() time.Time
+	secondPrecisionRange bool
+	queryRewriter        func(*QueryRequest) error
+	targetAuthorizer     func(context.Context, string) error
+
+	searchTransform func(string) string
+
+	typedTableCells bool
+	sortTableByTime bool
+	envelope        string
+	noHTMLEscape    bool
+
+	seriesDescending bool
+	sortSeriesByLast bool
+	sortSeriesDesc   bool
+	skipHidden       bool
+	outputLocation   *time.Location
+	timeResolution   TimeResolution
+	downsample       DownsampleMethod
+	infSentinels     bool
+	posInf, negInf   float64
+	streamQueries    bool
+	synthetic        bool
+	targetsHeader    bool
+	requireJSON      bool
+	strictMethods    bool
+	batchRequests    bool
+	maxAdhocFilters  int
+	partialResults   bool
+
+	cacheTTL      time.Duration
+	cacheStaleTTL time.Duration
+	cache         *queryCache
+
+	annotationIsRegion   bool
+	annotationRegionMode AnnotationRegionMode
+	annotationTagFilter  bool
+	annotationTagSep     *string
+	annotationText       *template.Template
+
+	errorLog *errorLog
+
+	queryTimeout           time.Duration
+	queryTimeoutFromTarget bool
+
+	decodeTimeout time.Duration
+
+	backendSem        chan struct{}
+	backendSemTimeout time.Duration
+
+	profiles map[string]*Handler
+
+	logger             Logger
+	slowQueryThreshold time.Duration
+
+	healthCheck func(context.Context) error
+	warmup      func(context.Context) error
+	gzip        bool
+	gzipMinSize int
+	middleware  []func(http.Handler) http.Handler
+	chain       http.Handler
+	pathPrefix  string
+
+	notFound    http.Handler
+	corsOrigins map[string]bool
+	recovery    bool
+	accessLog   *accessLog
+	telemetry   *telemetry
+	panicHook   func(*http.Request, interface{})
 
 	mux *http.ServeMux
 }
@@ -41,26 +135,114 @@ type Handler struct {
 // New creates a new http.Handler that will answer to the required endpoint for
 // a SimpleJSON source. You should use WithQuerier, WithTableQuerier,
 // WithAnnotator and WithSearch to set handlers for each of the endpionts.
+// New panics if an option, or the warmup, fails; use NewWithError to
+// handle such errors.
 func New(opts ...Opt) *Handler {
-	mux := http.NewServeMux()
-	Handler := &Handler{
-		mux: mux,
+	h, err := NewWithError(opts...)
+	if err != nil {
+		panic(err)
 	}
+	return h
+}
 
-	mux.HandleFunc("/", Handler.HandleRoot)
-	mux.HandleFunc("/query", Handler.HandleQuery)
-	mux.HandleFunc("/annotations", Handler.HandleAnnotations)
-	mux.HandleFunc("/search", Handler.HandleSearch)
-	mux.HandleFunc("/tag-keys", Handler.HandleTagKeys)
-	mux.HandleFunc("/tag-values", Handler.HandleTagValues)
+// NewWithError is like New, but returns an error, rather than panicking,
+// if an option is invalid or the warmup set with WithWarmup fails.
+func NewWithError(opts ...Opt) (*Handler, error) {
+	Handler := &Handler{
+		skipHidden: true,
+		mux:        http.NewServeMux(),
+	}
 
 	for _, o := range opts {
 		if err := o(Handler); err != nil {
-			panic(err)
+			return nil, err
+		}
+	}
+	if err := Handler.checkMetricsPath(); err != nil {
+		return nil, err
+	}
+	Handler.registerRoutes()
+
+	if Handler.cacheStaleTTL > 0 && Handler.cacheTTL == 0 {
+		return nil, errors.New("WithStaleWhileRevalidate requires WithQueryCache")
+	}
+	if Handler.cacheTTL > 0 {
+		Handler.cache = newQueryCache(Handler)
+	}
+
+	if len(Handler.middleware) > 0 {
+		Handler.chain = http.HandlerFunc(Handler.serveHTTP)
+		for i := len(Handler.middleware) - 1; i >= 0; i-- {
+			Handler.chain = Handler.middleware[i](Handler.chain)
+		}
+	}
+
+	if err := Handler.Warmup(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return Handler, nil
+}
+
+// registerRoutes registers each of the endpoints, below any prefix set
+// with WithPathPrefix.
+func (h *Handler) registerRoutes() {
+	p := h.pathPrefix
+	h.mux.HandleFunc(p+"/", h.HandleRoot)
+	h.mux.HandleFunc(p+"/query", h.postOnly(h.HandleQuery))
+	h.mux.HandleFunc(p+"/annotations", h.postOnly(h.HandleAnnotations))
+	h.mux.HandleFunc(p+"/search", h.postOnly(h.HandleSearch))
+	h.mux.HandleFunc(p+"/tag-keys", h.postOnly(h.HandleTagKeys))
+	h.mux.HandleFunc(p+"/tag-values", h.postOnly(h.HandleTagValues))
+	h.mux.HandleFunc(p+"/variable", h.HandleVariable)
+	h.mux.HandleFunc(p+"/metric-payload-options", h.HandleMetricPayloadOptions)
+
+	if h.errorLog != nil {
+		h.mux.HandleFunc(p+debugErrorsPath, h.HandleDebugErrors)
+	}
+	if h.telemetry != nil {
+		h.mux.HandleFunc(p+h.telemetry.path, h.HandleTelemetry)
+	}
+	for name, prof := range h.profiles {
+		h.mux.Handle(p+"/"+name+"/", http.StripPrefix(p+"/"+name, prof))
+	}
+}
+
+// WithPathPrefix serves all of the endpoints below prefix, e.g. with a
+// prefix of /grafana the query endpoint is /grafana/query, so that the
+// Handler can be mounted on an existing mux alongside other routes:
+//
+//	mux.Handle("/grafana/", simplejson.New(simplejson.WithPathPrefix("/grafana"), ...))
+func WithPathPrefix(prefix string) Opt {
+	return func(sjc *Handler) error {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path prefix %q must start with /", prefix)
 		}
+		sjc.pathPrefix = prefix
+		return nil
+	}
+}
+
+// WithWarmup sets a function that is called when the Handler is created,
+// and by Warmup, so that the data source can establish connections or
+// fill caches before serving requests.
+func WithWarmup(f func(ctx context.Context) error) Opt {
+	return func(sjc *Handler) error {
+		sjc.warmup = f
+		return nil
 	}
+}
 
-	return Handler
+// Warmup calls the function set with WithWarmup, if any.
+func (h *Handler) Warmup(ctx context.Context) error {
+	if h.warmup == nil {
+		return nil
+	}
+	if err := h.warmup(ctx); err != nil {
+		return fmt.Errorf("warmup failed, %w", err)
+	}
+	return nil
 }
 
 // WithSource will attempt to use the datasource provided as
@@ -71,6 +253,15 @@ func WithSource(src interface{}) Opt {
 		if q, ok := src.(Querier); ok {
 			sjc.query = q
 		}
+		if mq, ok := src.(MultiQuerier); ok {
+			sjc.multiQuery = mq
+		}
+		if bq, ok := src.(BandQuerier); ok {
+			sjc.bandQuery = bq
+		}
+		if fq, ok := src.(ForecastQuerier); ok {
+			sjc.forecastQuery = fq
+		}
 		if tq, ok := src.(TableQuerier); ok {
 			sjc.tableQuery = tq
 		}
@@ -80,9 +271,24 @@ func WithSource(src interface{}) Opt {
 		if s, ok := src.(Searcher); ok {
 			sjc.search = s
 		}
+		if s, ok := src.(SearcherV2); ok {
+			sjc.searchV2 = s
+		}
+		if s, ok := src.(StreamingSearcher); ok {
+			sjc.searchStream = s
+		}
+		if vs, ok := src.(VariableSearcher); ok {
+			sjc.variableSearch = vs
+		}
 		if ts, ok := src.(TagSearcher); ok {
 			sjc.tags = ts
 		}
+		if vr, ok := src.(VariableResolver); ok {
+			sjc.variables = vr
+		}
+		if mp, ok := src.(MetricPayloadOptioner); ok {
+			sjc.metricPayloadOptions = mp
+		}
 		return nil
 	}
 }
@@ -95,6 +301,15 @@ func WithQuerier(q Querier) Opt {
 	}
 }
 
+// WithMultiQuerier adds a timeserie query handler that can return several
+// series per target.
+func WithMultiQuerier(q MultiQuerier) Opt {
+	return func(sjc *Handler) error {
+		sjc.multiQuery = q
+		return nil
+	}
+}
+
 // WithTableQuerier adds a table query handler.
 func WithTableQuerier(q TableQuerier) Opt {
 	return func(sjc *Handler) error {
@@ -119,6 +334,25 @@ func WithSearcher(s Searcher) Opt {
 	}
 }
 
+// WithSearcherV2 adds a grouped search handler. Clients that do not request
+// grouped results will receive the flattened list of group members.
+func WithSearcherV2(s SearcherV2) Opt {
+	return func(sjc *Handler) error {
+		sjc.searchV2 = s
+		return nil
+	}
+}
+
+// WithSearchTransform sets a function applied to each search result before
+// it is returned, e.g. to normalise metric names for display. For grouped
+// results only the displayed text is transformed.
+func WithSearchTransform(f func(string) string) Opt {
+	return func(sjc *Handler) error {
+		sjc.searchTransform = f
+		return nil
+	}
+}
+
 // WithTagSearcher adds adhoc filter tag  search handlers.
 func WithTagSearcher(s TagSearcher) Opt {
 	return func(sjc *Handler) error {
@@ -127,501 +361,2253 @@ func WithTagSearcher(s TagSearcher) Opt {
 	}
 }
 
-// Opt provides configurable options for the Handler
-type Opt func(*Handler) error
-
-// QueryCommonArguments describes the arguments common to timeserie and
-// table queries.
-type QueryCommonArguments struct {
-	From, To time.Time
-	Filters  []QueryAdhocFilter
+// WithNowFunc sets the function used to find the current time when
+// resolving relative ranges. When set, requests that include a rangeRaw
+// such as "now-6h" to "now", but no absolute range, will have From and To
+// populated from the relative expressions.
+func WithNowFunc(now func() time.Time) Opt {
+	return func(sjc *Handler) error {
+		sjc.now = now
+		return nil
+	}
 }
 
-// QueryArguments defines the options to a timeserie query.
-type QueryArguments struct {
-	QueryCommonArguments
-	Interval time.Duration
-	MaxDPs   int
+// WithQueryRewriter sets a function that is called with each decoded
+// /query request before any targets are evaluated. The function may modify
+// the request, for instance to rewrite targets or add default filters. An
+// error returned from f is reported to the client as a 400 Bad Request.
+func WithQueryRewriter(f func(*QueryRequest) error) Opt {
+	return func(sjc *Handler) error {
+		sjc.queryRewriter = f
+		return nil
+	}
 }
 
-// TableQueryArguments defines the options to a table query.
-type TableQueryArguments struct {
-	QueryCommonArguments
+// WithTypedTableCells causes each cell of a table response to be sent as an
+// object holding the column type and the value, e.g.
+// {"type":"number","value":1}, for consumers that expect typed cells.
+func WithTypedTableCells() Opt {
+	return func(sjc *Handler) error {
+		sjc.typedTableCells = true
+		return nil
+	}
 }
 
-// A Querier responds to timeseri queries from Grafana
-type Querier interface {
-	GrafanaQuery(ctx context.Context, target string, args QueryArguments) ([]DataPoint, error)
+// WithSeriesOrder sets the order of the datapoints in each timeserie
+// response, ascending by time (the default) if asc is true, or descending,
+// most recent first, otherwise.
+func WithSeriesOrder(asc bool) Opt {
+	return func(sjc *Handler) error {
+		sjc.seriesDescending = !asc
+		return nil
+	}
 }
 
-// TagInfoer is an internal interface to describe difference types of tag.
-type TagInfoer interface {
-	tagName() string
-	tagType() string
+// WithSortSeriesByLastValue orders the timeserie results of each query by
+// the value of their most recent datapoint, descending if desc is true,
+// e.g. for top-N legends. Series with no datapoints, or whose most recent
+// value is null, are treated as having a value of -Inf. Other results,
+// such as tables, keep their position. Streamed responses are not sorted.
+func WithSortSeriesByLastValue(desc bool) Opt {
+	return func(sjc *Handler) error {
+		sjc.sortSeriesByLast = true
+		sjc.sortSeriesDesc = desc
+		return nil
+	}
 }
 
-// TagStringKey represent an adhoc query string key.
-type TagStringKey string
+// sortSeriesByLastValue sorts the timeserie results in out, as configured
+// by WithSortSeriesByLastValue.
+func (h *Handler) sortSeriesByLastValue(out []interface{}) {
+	var idx []int
+	var series []simpleJSONData
+	for i, o := range out {
+		if d, ok := o.(simpleJSONData); ok {
+			idx = append(idx, i)
+			series = append(series, d)
+		}
+	}
 
-func (k TagStringKey) tagName() string {
-	return string(k)
-}
+	last := func(d simpleJSONData) float64 {
+		v := math.Inf(-1)
+		var latest time.Time
+		for i, dp := range d.DataPoints {
+			if t := dp.Time.Time; i == 0 || t.After(latest) {
+				latest = t
+				v = dp.Value
+				if dp.Null || math.IsNaN(v) {
+					v = math.Inf(-1)
+				}
+			}
+		}
+		return v
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		if h.sortSeriesDesc {
+			return last(series[i]) > last(series[j])
+		}
+		return last(series[i]) < last(series[j])
+	})
 
-func (k TagStringKey) tagType() string {
-	return "string"
+	for i, d := range series {
+		out[idx[i]] = d
+	}
 }
 
-// TagValuer is in an internal interface used to describe tag
-// Values.
-type TagValuer interface {
-	tagValue() json.RawMessage
+// WithOutputLocation is for data sources that return naive local times,
+// i.e. times whose clock reading is local time in loc, but which are
+// marked as UTC (or another zone). The clock reading of each datapoint's
+// time is reinterpreted in loc before it is converted to epoch
+// milliseconds, so a point returned as 12:00 UTC, with a loc of UTC+2, is
+// sent as 10:00 UTC. Times that are already correct instants should not
+// use this option, as epoch milliseconds are independent of time zone. It
+// applies to the datapoints of timeserie, labeled, band and forecast
+// targets, but not to tables.
+func WithOutputLocation(loc *time.Location) Opt {
+	return func(sjc *Handler) error {
+		if loc == nil {
+			return errors.New("output location must not be nil")
+		}
+		sjc.outputLocation = loc
+		return nil
+	}
 }
 
-// TagStringValue represent an adhoc query string key.
-type TagStringValue string
-
-func (k TagStringValue) tagValue() json.RawMessage {
-	// We igore the error here because the following should
-	// always be marshable.
-	bs, _ := json.Marshal(struct {
-		Text string `json:"text"`
-	}{
-		Text: string(k),
-	})
-	return json.RawMessage(bs)
+// outputTime applies any location set with WithOutputLocation to t.
+func (h *Handler) outputTime(t time.Time) time.Time {
+	if h.outputLocation == nil {
+		return t
+	}
+	y, mo, d := t.Date()
+	return time.Date(y, mo, d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), h.outputLocation)
 }
 
-// A TagSearcher allows the querying of tag keys and values for adhoc filters.
-type TagSearcher interface {
-	GrafanaAdhocFilterTags(ctx context.Context) ([]TagInfoer, error)
-	GrafanaAdhocFilterTagValues(ctx context.Context, key string) ([]TagValuer, error)
-}
+// TimeResolution is the unit of the epoch timestamps of datapoints.
+type TimeResolution int
 
-// A TableQuerier responds to table queries from Grafana
-type TableQuerier interface {
-	GrafanaQueryTable(ctx context.Context, target string, args TableQueryArguments) ([]TableColumn, error)
-}
+// The supported time resolutions. TimeMillis is the default, as expected
+// by Grafana.
+const (
+	TimeMillis TimeResolution = iota
+	TimeMicros
+	TimeNanos
+	TimeSeconds
+)
 
-// AnnotationsArguments defines the options to a annotations query.
-type AnnotationsArguments struct {
-	QueryCommonArguments
+// epoch returns t as an epoch timestamp in units of r.
+func (r TimeResolution) epoch(t time.Time) int64 {
+	switch r {
+	case TimeMicros:
+		return t.UnixNano() / int64(time.Microsecond)
+	case TimeNanos:
+		return t.UnixNano()
+	case TimeSeconds:
+		return t.Unix()
+	default:
+		return t.UnixNano() / int64(time.Millisecond)
+	}
 }
 
-// An Annotator responds to queries for annotations from Grafana
-type Annotator interface {
-	GrafanaAnnotations(ctx context.Context, query string, args AnnotationsArguments) ([]Annotation, error)
+// WithTimeResolution sets the unit of the timestamps of the datapoints of
+// all series, including labeled, band and forecast targets, for downstream
+// consumers that need more, or less, precision than the default of
+// milliseconds. Other responses, such as annotations, always use
+// milliseconds.
+func WithTimeResolution(res TimeResolution) Opt {
+	return func(sjc *Handler) error {
+		if res < TimeMillis || res > TimeSeconds {
+			return fmt.Errorf("unknown time resolution %d", res)
+		}
+		sjc.timeResolution = res
+		return nil
+	}
 }
 
-// A Searcher responds to search queries from Grafana
-type Searcher interface {
-	GrafanaSearch(ctx context.Context, target string) ([]string, error)
+// WithSkipHidden sets whether targets the user has hidden, with "hide":
+// true, are skipped, which is the default. Skipped targets are not queried
+// and are omitted from the response.
+func WithSkipHidden(skip bool) Opt {
+	return func(sjc *Handler) error {
+		sjc.skipHidden = skip
+		return nil
+	}
 }
 
-// QueryAdhocFilter describes a user supplied filter to be added to
-// each query target.
-type QueryAdhocFilter struct {
-	Key      string `json:"key"`
-	Operator string `json:"operator"`
-	Value    string `json:"value"`
+// WithIncludeHidden causes hidden targets to be queried and returned, as
+// they were before hidden targets were skipped by default. It is
+// equivalent to WithSkipHidden(false).
+func WithIncludeHidden() Opt {
+	return WithSkipHidden(false)
 }
 
-// DataPoint represents a single datapoint at a given point in time.
-type DataPoint struct {
-	Time  time.Time
-	Value float64
+// WithStreamingQueries causes the result of each query target to be
+// written, and flushed if the ResponseWriter is an http.Flusher, as soon as
+// it is available, rather than once all targets have completed. As the
+// response status has been sent by the time later targets run, errors in
+// those targets are logged and the response truncated.
+func WithStreamingQueries() Opt {
+	return func(sjc *Handler) error {
+		sjc.streamQueries = true
+		return nil
+	}
 }
 
-// A TableNumberColumn holds values for a "number" column in a table.
-type TableNumberColumn []float64
+// TargetsHeader is the response header used by WithTargetsHeader.
+const TargetsHeader = "X-SimpleJSON-Targets"
 
-func (TableNumberColumn) simpleJSONColumn() {
+// WithTargetsHeader causes query responses to include a TargetsHeader
+// header listing, comma separated, the targets that were evaluated, after
+// any rewriting. This is intended as a debugging aid.
+func WithTargetsHeader() Opt {
+	return func(sjc *Handler) error {
+		sjc.targetsHeader = true
+		return nil
+	}
 }
 
-// A TableTimeColumn holds values for a "time" column in a table.
-type TableTimeColumn []time.Time
-
-func (TableTimeColumn) simpleJSONColumn() {
+// WithInfSentinels sets values to send in place of positive and negative
+// infinite datapoint values. By default, as JSON cannot represent them,
+// infinite values, like NaN, are sent as null.
+func WithInfSentinels(pos, neg float64) Opt {
+	return func(sjc *Handler) error {
+		sjc.infSentinels = true
+		sjc.posInf, sjc.negInf = pos, neg
+		return nil
+	}
 }
 
-// A TableStringColumn holds values for a "string" column in a table.
-type TableStringColumn []string
+// WithSortTableByTime causes the rows of table responses that have exactly
+// one time column to be sorted by that column, oldest first.
+func WithSortTableByTime() Opt {
+	return func(sjc *Handler) error {
+		sjc.sortTableByTime = true
+		return nil
+	}
+}
 
-func (TableStringColumn) simpleJSONColumn() {
+// WithDisableHTMLEscape stops <, > and & being escaped in JSON responses,
+// which is useful when table cells hold HTML or URLs with query parameters.
+func WithDisableHTMLEscape() Opt {
+	return func(sjc *Handler) error {
+		sjc.noHTMLEscape = true
+		return nil
+	}
 }
 
-// TableColumnData is a private interface to this package, you should
-// use one of TableStringColumn, TableNumberColumn, or TableTimeColumn
-type TableColumnData interface {
-	simpleJSONColumn()
+// WithResponseEnvelope wraps the JSON responses of all endpoints in an
+// object under key, e.g. {"data": [...]}, as required by some API gateways.
+// Grafana itself does not expect an envelope.
+func WithResponseEnvelope(key string) Opt {
+	return func(sjc *Handler) error {
+		if key == "" {
+			return errors.New("response envelope key must not be empty")
+		}
+		sjc.envelope = key
+		return nil
+	}
 }
 
-// TableColumn represents a single table column. Data should
-// be one the TableNumberColumn, TableStringColumn or TableTimeColumn types.
-type TableColumn struct {
-	Text string
-	Data TableColumnData
+// WithRequireJSONContentType causes requests to the data endpoints, such as
+// /query and /search, to be rejected with 415 Unsupported Media Type unless
+// they have a Content-Type of application/json. Requests for /, telemetry
+// and debug endpoints are not checked.
+func WithRequireJSONContentType() Opt {
+	return func(sjc *Handler) error {
+		sjc.requireJSON = true
+		return nil
+	}
 }
 
-// Annotation represents an annotation that can be displayed on a graph, or
-// in a table.
-type Annotation struct {
-	Time    time.Time `json:"time"`
-	TimeEnd time.Time `json:"timeEnd,omitempty"`
-	Title   string    `json:"title"`
-	Text    string    `json:"text"`
-	Tags    []string  `json:"tags"`
+// WithStrictMethods causes requests to /query, /search, /annotations,
+// /tag-keys and /tag-values to be rejected with 405 Method Not Allowed
+// unless they are a POST or OPTIONS. OPTIONS requests are answered with
+// 204 No Content and the allowed methods.
+func WithStrictMethods() Opt {
+	return func(sjc *Handler) error {
+		sjc.strictMethods = true
+		return nil
+	}
 }
 
-// HandleRoot serves a plain 200 OK for /, required by Grafana
-func (h *Handler) HandleRoot(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.Error(w, "File not found", http.StatusNotFound)
+// postOnly wraps hf to enforce WithStrictMethods.
+func (h *Handler) postOnly(hf http.HandlerFunc) http.HandlerFunc {
+	if !h.strictMethods {
+		return hf
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			hf(w, r)
+		case http.MethodOptions:
+			w.Header().Set("Allow", "POST, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "POST, OPTIONS")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
 	}
-	w.Write([]byte("OK"))
 }
 
-// simpleJSONTime is a wrapper for time.Time that reformats for
-type simpleJSONTime time.Time
+// isDataPath reports whether path is that of a data endpoint, other than /,
+// with or without a trailing slash.
+func (h *Handler) isDataPath(path string) bool {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, h.pathPrefix), "/")
+	for _, p := range dataPaths {
+		if p != "/" && path == p {
+			return true
+		}
+	}
+	return false
+}
 
-// MarshalJSON implements JSON marshalling
-func (sjt *simpleJSONTime) MarshalJSON() ([]byte, error) {
-	out := time.Time(*sjt).Format(time.RFC3339Nano)
-	return json.Marshal(out)
+// WithDecodeTimeout limits the time allowed to read and decode a request
+// body. Requests whose body is not read within d fail with 408 Request
+// Timeout, protecting against slow clients.
+func WithDecodeTimeout(d time.Duration) Opt {
+	return func(sjc *Handler) error {
+		sjc.decodeTimeout = d
+		return nil
+	}
 }
 
-// UnmarshalJSON implements JSON unmarshalling
-func (sjt *simpleJSONTime) UnmarshalJSON(injs []byte) error {
-	in := ""
-	err := json.Unmarshal(injs, &in)
-	if err != nil {
-		return err
+// WithQueryTimeout sets a timeout applied to the context passed to the
+// Querier or TableQuerier for each target. Queries that fail once the
+// timeout has passed are reported with status 504 Gateway Timeout.
+func WithQueryTimeout(d time.Duration) Opt {
+	return func(sjc *Handler) error {
+		sjc.queryTimeout = d
+		return nil
 	}
+}
 
-	t, err := time.Parse(time.RFC3339Nano, in)
-	if err != nil {
-		return err
+// WithQueryTimeoutFromTarget allows each target to override the timeout set
+// by WithQueryTimeout with a "timeout" in the target's data payload, e.g.
+// {"target": "a", "data": {"timeout": "5s"}}. The timeout may be a duration
+// string or a number of milliseconds.
+func WithQueryTimeoutFromTarget() Opt {
+	return func(sjc *Handler) error {
+		sjc.queryTimeoutFromTarget = true
+		return nil
 	}
+}
 
-	*sjt = simpleJSONTime(t)
+// ProfileHeader is the request header that may be used to select a
+// profile registered with WithProfile.
+const ProfileHeader = "X-Simplejson-Profile"
 
-	return nil
+// WithProfile registers a named profile, a separate datasource configured
+// with opts. Requests are routed to the profile either by prefixing the
+// endpoint path with the profile name, e.g. /name/query, or by setting the
+// ProfileHeader request header to the profile name.
+func WithProfile(name string, opts ...Opt) Opt {
+	return func(sjc *Handler) error {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid profile name %q", name)
+		}
+		if _, ok := sjc.profiles[name]; ok {
+			return fmt.Errorf("duplicate profile %q", name)
+		}
+		if sjc.profiles == nil {
+			sjc.profiles = map[string]*Handler{}
+		}
+		p, err := NewWithError(opts...)
+		if err != nil {
+			return fmt.Errorf("profile %q, %w", name, err)
+		}
+		sjc.profiles[name] = p
+		return nil
+	}
 }
 
-type simpleJSONDuration time.Duration
+// WithSecondPrecisionRange truncates the From and To times of each request
+// to whole seconds before they are passed to the data source, for backends
+// that do not accept fractional seconds.
+func WithSecondPrecisionRange() Opt {
+	return func(sjc *Handler) error {
+		sjc.secondPrecisionRange = true
+		return nil
+	}
+}
+
+// WithAnnotationTagsAsString sends the tags of annotations as a single
+// string, joined by sep, rather than an array, for consumers that expect
+// that form.
+func WithAnnotationTagsAsString(sep string) Opt {
+	return func(sjc *Handler) error {
+		sjc.annotationTagSep = &sep
+		return nil
+	}
+}
+
+// WithAnnotationTextTemplate sets a text/template used to render the Text
+// of each annotation, executed with the Annotation, e.g.
+//
+//	{{.Title}} at {{.Time.Format "15:04"}}: {{.Text}}
+func WithAnnotationTextTemplate(tmpl string) Opt {
+	return func(sjc *Handler) error {
+		t, err := template.New("annotation").Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("invalid annotation text template, %w", err)
+		}
+		sjc.annotationText = t
+		return nil
+	}
+}
+
+// AnnotationRegionMode selects how annotations with a TimeEnd are sent.
+type AnnotationRegionMode int
+
+// The supported annotation region modes. AnnotationRegionPair, the
+// default, sends a region as two annotations, for its start and end,
+// sharing a regionId. AnnotationRegionSingle sends a single annotation
+// with both "time" and "timeEnd", as understood by recent Grafana versions.
+const (
+	AnnotationRegionPair AnnotationRegionMode = iota
+	AnnotationRegionSingle
+)
+
+// WithAnnotationRegionMode sets how annotations that have a TimeEnd are
+// sent.
+func WithAnnotationRegionMode(mode AnnotationRegionMode) Opt {
+	return func(sjc *Handler) error {
+		if mode != AnnotationRegionPair && mode != AnnotationRegionSingle {
+			return fmt.Errorf("unknown annotation region mode %d", mode)
+		}
+		sjc.annotationRegionMode = mode
+		return nil
+	}
+}
+
+// WithAnnotationIsRegion adds an explicit "isRegion": true to both
+// responses of annotations that have a TimeEnd, for older plugins that
+// require it rather than relying on regionId.
+func WithAnnotationIsRegion() Opt {
+	return func(sjc *Handler) error {
+		sjc.annotationIsRegion = true
+		return nil
+	}
+}
+
+// WithTargetAuthorizer sets a function that is called for each query target
+// before it is passed to the data source. If f returns an error the target
+// is not queried and the request fails with 403 Forbidden, unless the error
+// is a StatusError carrying a different status.
+func WithTargetAuthorizer(f func(ctx context.Context, target string) error) Opt {
+	return func(sjc *Handler) error {
+		sjc.targetAuthorizer = f
+		return nil
+	}
+}
+
+// Opt provides configurable options for the Handler
+type Opt func(*Handler) error
+
+// QueryCommonArguments describes the arguments common to timeserie and
+// table queries.
+type QueryCommonArguments struct {
+	From, To time.Time
+	Filters  []QueryAdhocFilter
+
+	// Location is the user's timezone, if one was sent with the request,
+	// otherwise nil.
+	Location *time.Location
+}
+
+// QueryArguments defines the options to a timeserie query.
+type QueryArguments struct {
+	QueryCommonArguments
+	Interval time.Duration
+	MaxDPs   int
+
+	// RefID is Grafana's identifier of the target within the panel, e.g.
+	// "A", and Hide is set if the user has hidden the target.
+	RefID string
+	Hide  bool
+
+	// Downsample is the downsampling method requested by the target's data
+	// payload, if any.
+	Downsample DownsampleMethod
+}
+
+// QueryTarget describes a single target of a query request. Data holds the
+// target's free form data payload, as sent by the client.
+type QueryTarget struct {
+	Target  string
+	RefID   string
+	Type    string
+	Hide    bool
+	Filters []QueryAdhocFilter
+	Data    json.RawMessage
+}
+
+// QueryRequest is a modifiable view of a decoded query request, as passed
+// to the function given to WithQueryRewriter.
+type QueryRequest struct {
+	From, To      time.Time
+	Interval      time.Duration
+	MaxDataPoints int
+	Targets       []QueryTarget
+	Filters       []QueryAdhocFilter
+}
+
+// TableQueryArguments defines the options to a table query.
+type TableQueryArguments struct {
+	QueryCommonArguments
+
+	// Cursor identifies the page of a paged table to return, and is empty
+	// for the first page. It is taken from the "cursor" field of the
+	// target's data payload, or the request's "cursor" query parameter.
+	Cursor string
+
+	// RefID is Grafana's identifier of the target within the panel, e.g.
+	// "A", and Hide is set if the user has hidden the target.
+	RefID string
+	Hide  bool
+}
+
+// A Querier responds to timeseri queries from Grafana. Returning no
+// datapoints, including a nil slice, with a nil error results in a series
+// with an empty datapoints array; it is not treated as an error.
+type Querier interface {
+	GrafanaQuery(ctx context.Context, target string, args QueryArguments) ([]DataPoint, error)
+}
+
+// Series is a named set of datapoints.
+type Series struct {
+	Target     string
+	DataPoints []DataPoint
+}
+
+// A MultiQuerier responds to timeserie queries from Grafana where a single
+// target may result in several series, e.g. one per host. Each series is
+// returned as a separate entry in the response. If a MultiQuerier is
+// configured it is used in preference to a Querier.
+type MultiQuerier interface {
+	GrafanaMultiQuery(ctx context.Context, target string, args QueryArguments) ([]Series, error)
+}
+
+// SeriesHints are optional rendering hints for a timeserie, sent as "fill"
+// and "stack" fields alongside the datapoints for plugins that read them.
+// Fill is the fill opacity from 1 to 10, Stack names the stack group the
+// series should be stacked with. Unit and Decimals describe how values
+// should be formatted, and are sent in a "meta" object, e.g.
+// {"meta": {"unit": "bytes", "decimals": 1}}. Zero values are omitted.
+//
+// MaxAge is how long the series may be cached by the client. If every
+// series in a query response has a MaxAge, the response is sent with a
+// Cache-Control max-age of the shortest of them. Streamed responses are
+// never given a Cache-Control header.
+type SeriesHints struct {
+	Fill     int
+	Stack    string
+	Unit     string
+	Decimals *int
+	MaxAge   time.Duration
+}
+
+// A SeriesHinter may be implemented by a Querier to supply rendering hints
+// for the series returned for a target.
+type SeriesHinter interface {
+	GrafanaSeriesHints(ctx context.Context, target string) (SeriesHints, error)
+}
+
+// TagInfoer is an internal interface to describe difference types of tag.
+type TagInfoer interface {
+	tagName() string
+	tagType() string
+}
+
+// TagStringKey represent an adhoc query string key.
+type TagStringKey string
+
+func (k TagStringKey) tagName() string {
+	return string(k)
+}
+
+func (k TagStringKey) tagType() string {
+	return "string"
+}
+
+// TagValuer is in an internal interface used to describe tag
+// Values.
+type TagValuer interface {
+	tagValue() json.RawMessage
+}
+
+// TagStringValue represent an adhoc query string key.
+type TagStringValue string
+
+func (k TagStringValue) tagValue() json.RawMessage {
+	// We igore the error here because the following should
+	// always be marshable.
+	bs, _ := json.Marshal(struct {
+		Text string `json:"text"`
+	}{
+		Text: string(k),
+	})
+	return json.RawMessage(bs)
+}
+
+// TagTextValue represent an adhoc query tag value with a display Text
+// distinct from the Value filtered on, marshalled as
+// {"text": "London", "value": "lon-1"}.
+type TagTextValue struct {
+	Text  string
+	Value string
+}
+
+func (k TagTextValue) tagValue() json.RawMessage {
+	bs, _ := json.Marshal(struct {
+		Text  string `json:"text"`
+		Value string `json:"value"`
+	}{
+		Text:  k.Text,
+		Value: k.Value,
+	})
+	return json.RawMessage(bs)
+}
+
+// TagNumberValue represent a numeric adhoc query tag value, such as a
+// port or status code, marshalled as {"text": 443}.
+type TagNumberValue float64
+
+func (k TagNumberValue) tagValue() json.RawMessage {
+	bs, _ := json.Marshal(struct {
+		Text float64 `json:"text"`
+	}{
+		Text: float64(k),
+	})
+	return json.RawMessage(bs)
+}
+
+// RangeTagValuer describes the range of values of a numeric tag key, for
+// UIs that render a slider rather than a list of values. It is marshalled
+// as {"text":"0 - 100","min":0,"max":100}, the text allowing clients that
+// do not understand ranges to still display it.
+type RangeTagValuer struct {
+	Min, Max float64
+}
+
+func (v RangeTagValuer) tagValue() json.RawMessage {
+	bs, _ := json.Marshal(struct {
+		Text string  `json:"text"`
+		Min  float64 `json:"min"`
+		Max  float64 `json:"max"`
+	}{
+		Text: fmt.Sprintf("%v - %v", v.Min, v.Max),
+		Min:  v.Min,
+		Max:  v.Max,
+	})
+	return json.RawMessage(bs)
+}
+
+// A TagSearcher allows the querying of tag keys and values for adhoc filters.
+// The organisation and user making the request are available from the
+// context with OrgIDFromContext and UserFromContext, allowing tenant
+// specific tags.
+type TagSearcher interface {
+	GrafanaAdhocFilterTags(ctx context.Context) ([]TagInfoer, error)
+	GrafanaAdhocFilterTagValues(ctx context.Context, key string) ([]TagValuer, error)
+}
+
+// A TableQuerier responds to table queries from Grafana
+type TableQuerier interface {
+	GrafanaQueryTable(ctx context.Context, target string, args TableQueryArguments) ([]TableColumn, error)
+}
+
+// A PagedTableQuerier may be implemented by a TableQuerier to return large
+// tables a page at a time. It is called in place of GrafanaQueryTable with
+// the requested cursor, and returns the page along with the cursor of the
+// next page, which is sent as {"meta": {"nextCursor": "..."}} in the table
+// response. An empty next cursor marks the last page.
+type PagedTableQuerier interface {
+	GrafanaQueryTablePage(ctx context.Context, target string, args TableQueryArguments) (page []TableColumn, next string, err error)
+}
+
+// AnnotationsArguments defines the options to a annotations query.
+type AnnotationsArguments struct {
+	QueryCommonArguments
+}
+
+// An Annotator responds to queries for annotations from Grafana
+type Annotator interface {
+	GrafanaAnnotations(ctx context.Context, query string, args AnnotationsArguments) ([]Annotation, error)
+}
+
+// A Searcher responds to search queries from Grafana
+type Searcher interface {
+	GrafanaSearch(ctx context.Context, target string) ([]string, error)
+}
+
+// SearchGroup is a named category of search results.
+type SearchGroup struct {
+	Text     string
+	Children []string
+}
+
+// A SearcherV2 responds to search queries from Grafana with results
+// organised into groups.
+type SearcherV2 interface {
+	GrafanaSearchGrouped(ctx context.Context, target string) ([]SearchGroup, error)
+}
+
+// QueryAdhocFilter describes a user supplied filter to be added to
+// each query target.
+type QueryAdhocFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// DataPoint represents a single datapoint at a given point in time.
+// Datapoints are sent to Grafana as [value, time] pairs, exactly as returned
+// by the Querier (after sorting by time); no alignment or gap filling is
+// applied, so series may be sparse.
+//
+// Labels are only sent for targets of type "labeled", for which each
+// datapoint is sent as an object, {"value":1,"time":1000,"labels":{...}},
+// rather than a pair. Other targets are unaffected by labels.
+//
+// If Null is set the value is sent as null, [null, time], which Grafana
+// renders as a gap in the series rather than a value; Value is ignored.
+type DataPoint struct {
+	Time   time.Time
+	Value  float64
+	Labels map[string]string
+	Null   bool
+}
+
+// NullDataPoint returns a datapoint at t with a null value.
+func NullDataPoint(t time.Time) DataPoint {
+	return DataPoint{Time: t, Null: true}
+}
+
+// SparseSeries returns the datapoints in dps that carry a value, dropping
+// any that are Null or whose Value is NaN, which may be used to mark
+// missing data. Panels will interpolate across the dropped points rather
+// than showing gaps.
+func SparseSeries(dps []DataPoint) []DataPoint {
+	out := make([]DataPoint, 0, len(dps))
+	for _, dp := range dps {
+		if dp.Null || math.IsNaN(dp.Value) {
+			continue
+		}
+		out = append(out, dp)
+	}
+	return out
+}
+
+// Rate returns the per-second rate of change between consecutive points of
+// a counter series. Each rate is given the time of the later point of the
+// pair. Points are sorted by time first. Pairs including a null point give
+// a null rate, so gaps are preserved. Pairs where the value decreases,
+// indicating a counter reset, or where the time does not advance, are
+// dropped.
+func Rate(points []DataPoint) []DataPoint {
+	sorted := append([]DataPoint(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	var out []DataPoint
+	for i := 1; i < len(sorted); i++ {
+		prev, cur := sorted[i-1], sorted[i]
+		dt := cur.Time.Sub(prev.Time).Seconds()
+		if dt > 0 && (prev.Null || cur.Null) {
+			out = append(out, NullDataPoint(cur.Time))
+			continue
+		}
+		dv := cur.Value - prev.Value
+		if dt <= 0 || dv < 0 {
+			continue
+		}
+		out = append(out, DataPoint{Time: cur.Time, Value: dv / dt})
+	}
+	return out
+}
+
+// A TableNumberColumn holds values for a "number" column in a table.
+type TableNumberColumn []float64
+
+func (TableNumberColumn) simpleJSONColumn() {
+}
+
+// A TableTimeColumn holds values for a "time" column in a table.
+type TableTimeColumn []time.Time
+
+func (TableTimeColumn) simpleJSONColumn() {
+}
+
+// A TableStringColumn holds values for a "string" column in a table.
+type TableStringColumn []string
+
+func (TableStringColumn) simpleJSONColumn() {
+}
+
+// A TableBoolColumn holds values for a "bool" column in a table.
+type TableBoolColumn []bool
+
+func (TableBoolColumn) simpleJSONColumn() {
+}
+
+// TableColumnData is a private interface to this package, you should
+// use one of TableStringColumn, TableNumberColumn, TableTimeColumn or
+// TableBoolColumn
+type TableColumnData interface {
+	simpleJSONColumn()
+}
+
+// TableColumn represents a single table column. Data should be one the
+// TableNumberColumn, TableStringColumn, TableTimeColumn or TableBoolColumn
+// types.
+// Unit optionally sets the Grafana unit used to format the column, using
+// Grafana's unit identifiers, e.g. "bytes", "ms", "s", "percent",
+// "percentunit" or "short". It is omitted when empty. Columns are sent
+// stably sorted by Order, so the return order is preserved if it is unset.
+// Footer is the number of rows at the end of Data that are summary rows,
+// as added by TableSummary; the footer of the first column applies to the
+// table. Footer rows are kept last when the table is sorted, and their
+// cells are sent as null, other than those of number columns.
+type TableColumn struct {
+	Text   string
+	Data   TableColumnData
+	Unit   string
+	Order  int
+	Footer int
+}
+
+// Annotation represents an annotation that can be displayed on a graph, or
+// in a table. Markdown marks the Text as Markdown; it is passed through as
+// a "markdown" field, which the stock simplejson plugin ignores, but which
+// plugins that support it use to render the text. Source optionally names
+// the system the annotation came from, and is sent as "source" when set.
+// Value optionally attaches a number, such as a deploy number, sent as
+// "value"; the stock plugin ignores it, but it is shown on hover by
+// consumers that support it. EndTitle and EndText, if set, replace the
+// Title and Text of the region end annotation of a ranged annotation, e.g.
+// "deploy finished"; they are not used with AnnotationRegionSingle.
+type Annotation struct {
+	Time     time.Time `json:"time"`
+	TimeEnd  time.Time `json:"timeEnd,omitempty"`
+	Title    string    `json:"title"`
+	Text     string    `json:"text"`
+	EndTitle string    `json:"endTitle,omitempty"`
+	EndText  string    `json:"endText,omitempty"`
+	Tags     []string  `json:"tags"`
+	Markdown bool      `json:"markdown,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Value    *float64  `json:"value,omitempty"`
+}
+
+// HandleRoot serves a plain 200 OK for /, required by Grafana. If a health
+// check has been set with WithHealthCheck, and it fails, a 503 is returned
+// instead. Paths of other endpoints with a trailing slash, such as /query/,
+// are served by that endpoint. Requests for unknown paths are passed to any
+// handler set with WithNotFoundHandler.
+func (h *Handler) HandleRoot(w http.ResponseWriter, r *http.Request) {
+	root := h.pathPrefix + "/"
+	if r.URL.Path != root && strings.HasSuffix(r.URL.Path, "/") {
+		u := *r.URL
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		u.RawPath = ""
+		r2 := r.WithContext(r.Context())
+		r2.URL = &u
+		if _, pattern := h.mux.Handler(r2); pattern != root && pattern != "" {
+			h.mux.ServeHTTP(w, r2)
+			return
+		}
+	}
+	if r.URL.Path != root {
+		if h.notFound != nil {
+			h.notFound.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if h.healthCheck != nil {
+		if err := h.healthCheck(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("OK"))
+}
+
+// WithNotFoundHandler sets the handler used for requests to unknown paths,
+// e.g. to return a JSON error or redirect to documentation.
+func WithNotFoundHandler(nf http.Handler) Opt {
+	return func(sjc *Handler) error {
+		sjc.notFound = nf
+		return nil
+	}
+}
+
+// WithHealthCheck sets a function called, with the request context, when
+// Grafana tests the datasource. If it returns an error the test fails with
+// a 503 and the error text, e.g. when a backing database is unavailable.
+func WithHealthCheck(f func(ctx context.Context) error) Opt {
+	return func(sjc *Handler) error {
+		sjc.healthCheck = f
+		return nil
+	}
+}
+
+// simpleJSONTime is a wrapper for time.Time that reformats for
+type simpleJSONTime time.Time
+
+// MarshalJSON implements JSON marshalling
+func (sjt *simpleJSONTime) MarshalJSON() ([]byte, error) {
+	out := time.Time(*sjt).Format(time.RFC3339Nano)
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON implements JSON unmarshalling
+func (sjt *simpleJSONTime) UnmarshalJSON(injs []byte) error {
+	in := ""
+	err := json.Unmarshal(injs, &in)
+	if err != nil {
+		return err
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, in)
+	if err != nil {
+		return err
+	}
+
+	*sjt = simpleJSONTime(t)
+
+	return nil
+}
+
+type simpleJSONDuration time.Duration
+
+func (sjd *simpleJSONDuration) MarshalJSON() ([]byte, error) {
+	out := time.Duration(*sjd).String()
+	return json.Marshal(out)
+}
+
+func (sjd *simpleJSONDuration) UnmarshalJSON(injs []byte) error {
+	in := ""
+	err := json.Unmarshal(injs, &in)
+	if err != nil {
+		return err
+	}
+
+	d, err := time.ParseDuration(in)
+	if err != nil {
+		return err
+	}
+
+	*sjd = simpleJSONDuration(d)
+
+	return nil
+}
+
+type simpleJSONRawRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type simpleJSONRange struct {
+	From simpleJSONTime     `json:"from"`
+	To   simpleJSONTime     `json:"to"`
+	Raw  simpleJSONRawRange `json:"raw"`
+}
+
+// resolveRange populates any missing absolute times in rng from the
+// relative expressions in raw, falling back to the range's own raw field,
+// if WithNowFunc has been used. Relative times are rounded in loc, if it is
+// not nil. If WithSecondPrecisionRange has been used the times are then
+// truncated to whole seconds.
+func (h *Handler) resolveRange(rng *simpleJSONRange, raw simpleJSONRawRange, loc *time.Location) error {
+	if h.now != nil {
+		if err := h.resolveRelativeRange(rng, raw, loc); err != nil {
+			return err
+		}
+	}
+
+	if h.secondPrecisionRange {
+		rng.From = simpleJSONTime(time.Time(rng.From).Truncate(time.Second))
+		rng.To = simpleJSONTime(time.Time(rng.To).Truncate(time.Second))
+	}
+
+	return nil
+}
+
+// parseTimezone parses the timezone sent by Grafana. The browser's
+// timezone is not known to the server, so "browser", like an empty
+// timezone, results in a nil location.
+func parseTimezone(tz string) (*time.Location, error) {
+	switch {
+	case tz == "", tz == "browser":
+		return nil, nil
+	case strings.EqualFold(tz, "utc"):
+		return time.UTC, nil
+	default:
+		return time.LoadLocation(tz)
+	}
+}
+
+func (h *Handler) resolveRelativeRange(rng *simpleJSONRange, raw simpleJSONRawRange, loc *time.Location) error {
+	if raw.From == "" && raw.To == "" {
+		raw = rng.Raw
+	}
+
+	now := h.now()
+	if loc != nil {
+		now = now.In(loc)
+	}
+	if time.Time(rng.From).IsZero() && raw.From != "" {
+		t, err := parseRelativeTime(raw.From, now, false)
+		if err != nil {
+			return err
+		}
+		rng.From = simpleJSONTime(t)
+	}
+	if time.Time(rng.To).IsZero() && raw.To != "" {
+		t, err := parseRelativeTime(raw.To, now, true)
+		if err != nil {
+			return err
+		}
+		rng.To = simpleJSONTime(t)
+	}
+
+	return nil
+}
+
+type simpleJSONTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Hide   bool   `json:"hide"`
+	Type   string `json:"type"`
+
+	AdhocFilters []QueryAdhocFilter `json:"adhocFilters"`
+
+	// Data holds the free form per-target payload sent by newer versions
+	// of the plugin.
+	Data json.RawMessage `json:"data"`
+}
+
+// queryType returns the target's type in lower case. The plurals sent by
+// some clients, e.g. "timeSeries", are treated as their singular.
+func (t simpleJSONTarget) queryType() string {
+	typ := strings.ToLower(t.Type)
+	switch typ {
+	case "timeseries":
+		return "timeserie"
+	case "tables":
+		return "table"
+	}
+	return typ
+}
+
+// simpleJSONTargets holds the targets of a query. Targets are usually sent
+// as an array, but may also be sent as an object keyed by refId, e.g.
+// {"A": {"target": "upper_50"}}, in which case they are ordered by key and
+// the key is used as the refId of any target that lacks one.
+type simpleJSONTargets []simpleJSONTarget
+
+func (ts *simpleJSONTargets) UnmarshalJSON(injs []byte) error {
+	var list []simpleJSONTarget
+	if err := json.Unmarshal(injs, &list); err == nil {
+		*ts = list
+		return nil
+	}
+
+	keyed := map[string]simpleJSONTarget{}
+	if err := json.Unmarshal(injs, &keyed); err != nil {
+		return errors.New("targets must be an array or an object")
+	}
+
+	keys := make([]string, 0, len(keyed))
+	for k := range keyed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	list = make([]simpleJSONTarget, 0, len(keys))
+	for _, k := range keys {
+		t := keyed[k]
+		if t.RefID == "" {
+			t.RefID = k
+		}
+		list = append(list, t)
+	}
+	*ts = list
+	return nil
+}
+
+type simpleJSONTargetData struct {
+	Timeout    json.RawMessage  `json:"timeout"`
+	Downsample DownsampleMethod `json:"downsample"`
+	Cursor     string           `json:"cursor"`
+}
+
+// data decodes the target's data payload. Payloads that are not objects
+// are ignored.
+func (t simpleJSONTarget) data() simpleJSONTargetData {
+	data := simpleJSONTargetData{}
+	if len(t.Data) > 0 {
+		if err := json.Unmarshal(t.Data, &data); err != nil {
+			return simpleJSONTargetData{}
+		}
+	}
+	return data
+}
+
+// timeout returns the timeout given in the target's data payload, if any.
+// The timeout may be given as a duration string, e.g. "5s", or as a number
+// of milliseconds.
+func (t simpleJSONTarget) timeout() (time.Duration, error) {
+	data := t.data()
+	if len(data.Timeout) == 0 {
+		return 0, nil
+	}
+
+	var ms float64
+	if err := json.Unmarshal(data.Timeout, &ms); err == nil {
+		return time.Duration(ms * float64(time.Millisecond)), nil
+	}
+
+	var d simpleJSONDuration
+	if err := json.Unmarshal(data.Timeout, &d); err != nil {
+		return 0, fmt.Errorf("invalid timeout for target %q, %v", t.Target, err)
+	}
+	return time.Duration(d), nil
+}
+
+/*
+{
+  "panelId": 1,
+  "range": {
+    "from": "2016-10-31T06:33:44.866Z",
+    "to": "2016-10-31T12:33:44.866Z",
+    "raw": {
+      "from": "now-6h",
+      "to": "now"
+    }
+  },
+  "rangeRaw": {
+    "from": "now-6h",
+    "to": "now"
+  },
+  "interval": "30s",
+  "intervalMs": 30000,
+  "targets": [
+    { "target": "upper_50", refId: "A" , "hide": false. "type"; "timeserie"},
+    { "target": "upper_75", refId: "B" }
+  ],
+  "format": "json",
+  "maxDataPoints": 550
+}
+*/
 
-func (sjd *simpleJSONDuration) MarshalJSON() ([]byte, error) {
-	out := time.Duration(*sjd).String()
+type simpleJSONQuery struct {
+	PanelID       int                `json:"panelId"`
+	Range         simpleJSONRange    `json:"range"`
+	RangeRaw      simpleJSONRawRange `json:"rangeRaw"`
+	Interval      simpleJSONDuration `json:"interval"`
+	IntervalMS    int                `json:"intervalMs"`
+	Targets       simpleJSONTargets  `json:"targets"`
+	Format        string             `json:"format"`
+	MaxDataPoints int                `json:"maxDataPoints"`
+	AdhocFilters  []QueryAdhocFilter `json:"adhocFilters"`
+
+	// AltAdhocFilters holds filters sent by plugin forks that use
+	// "adhoc_filters" rather than "adhocFilters".
+	AltAdhocFilters []QueryAdhocFilter `json:"adhoc_filters"`
+
+	// Timezone is the user's timezone, as an IANA name, "utc" or
+	// "browser".
+	Timezone string `json:"timezone"`
+	location *time.Location
+
+	// cursor is the table page cursor from the request's query parameters.
+	cursor string
+
+	// out, if set, allows targets to write their entries directly to
+	// the response, see RowTableQuerier.
+	out *queryOutput
+
+	// maxAge, if set, collects the MaxAge hints of the response's series.
+	maxAge *responseMaxAge
+}
+
+// UnmarshalJSON implements JSON unmarshalling. Some plugin versions send
+// "adhocFilters" as an object keyed by refId, rather than an array; such
+// filters are moved to the matching targets.
+func (req *simpleJSONQuery) UnmarshalJSON(bs []byte) error {
+	type plain simpleJSONQuery
+	raw := struct {
+		*plain
+		AdhocFilters json.RawMessage `json:"adhocFilters"`
+	}{plain: (*plain)(req)}
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		return err
+	}
+
+	filters := bytes.TrimSpace(raw.AdhocFilters)
+	if len(filters) == 0 || filters[0] != '{' {
+		req.AdhocFilters = nil
+		if len(filters) == 0 {
+			return nil
+		}
+		return json.Unmarshal(filters, &req.AdhocFilters)
+	}
+
+	byRef := map[string][]QueryAdhocFilter{}
+	if err := json.Unmarshal(filters, &byRef); err != nil {
+		return err
+	}
+	for i := range req.Targets {
+		if fs, ok := byRef[req.Targets[i].RefID]; ok {
+			req.Targets[i].AdhocFilters = fs
+		}
+	}
+	return nil
+}
+
+// filters returns the adhoc filters that apply to the given target.
+// Filters are taken from the first non-empty of the request's
+// "adhocFilters", the request's "adhoc_filters", and finally the target's
+// own "adhocFilters", which includes any filters keyed by its refId.
+func (req simpleJSONQuery) filters(target simpleJSONTarget) []QueryAdhocFilter {
+	switch {
+	case len(req.AdhocFilters) > 0:
+		return req.AdhocFilters
+	case len(req.AltAdhocFilters) > 0:
+		return req.AltAdhocFilters
+	default:
+		return target.AdhocFilters
+	}
+}
+
+// hasTableTarget reports whether any of the request's targets is a table.
+func (req *simpleJSONQuery) hasTableTarget() bool {
+	for _, t := range req.Targets {
+		if t.queryType() == "table" {
+			return true
+		}
+	}
+	return false
+}
+
+// queryRequest returns an exported view of the request.
+func (req *simpleJSONQuery) queryRequest() *QueryRequest {
+	qr := &QueryRequest{
+		From:          time.Time(req.Range.From),
+		To:            time.Time(req.Range.To),
+		Interval:      time.Duration(req.Interval),
+		MaxDataPoints: req.MaxDataPoints,
+		Filters:       req.AdhocFilters,
+	}
+	if len(qr.Filters) == 0 {
+		qr.Filters = req.AltAdhocFilters
+	}
+	for _, t := range req.Targets {
+		qr.Targets = append(qr.Targets, QueryTarget{
+			Target:  t.Target,
+			RefID:   t.RefID,
+			Type:    t.Type,
+			Hide:    t.Hide,
+			Filters: t.AdhocFilters,
+			Data:    t.Data,
+		})
+	}
+	return qr
+}
+
+// applyQueryRequest updates the request from a, possibly modified, view.
+func (req *simpleJSONQuery) applyQueryRequest(qr *QueryRequest) {
+	req.Range.From = simpleJSONTime(qr.From)
+	req.Range.To = simpleJSONTime(qr.To)
+	req.Interval = simpleJSONDuration(qr.Interval)
+	req.MaxDataPoints = qr.MaxDataPoints
+	req.AdhocFilters = qr.Filters
+	req.AltAdhocFilters = nil
+	req.Targets = nil
+	for _, t := range qr.Targets {
+		req.Targets = append(req.Targets, simpleJSONTarget{
+			Target:       t.Target,
+			RefID:        t.RefID,
+			Type:         t.Type,
+			Hide:         t.Hide,
+			AdhocFilters: t.Filters,
+			Data:         t.Data,
+		})
+	}
+}
+
+/*
+[
+  {
+    "target":"upper_75", // The field being queried for
+    "datapoints":[
+      [622,1450754160000],  // Metric value as a float , unixtimestamp in milliseconds
+      [365,1450754220000]
+    ]
+  },
+  {
+    "target":"upper_90",
+    "datapoints":[
+      [861,1450754160000],
+      [767,1450754220000]
+    ]
+  }
+]
+*/
+
+type simpleJSONPTime time.Time
+
+func (sjdpt *simpleJSONPTime) MarshalJSON() ([]byte, error) {
+	out := time.Time(*sjdpt).UnixNano() / 1000000
+	return json.Marshal(out)
+}
+
+func (sjdpt *simpleJSONPTime) UnmarshalJSON(injs []byte) error {
+	in := int64(0)
+	err := json.Unmarshal(injs, &in)
+	if err != nil {
+		return err
+	}
+
+	t := time.Unix(0, in*1000000)
+
+	*sjdpt = simpleJSONPTime(t)
+
+	return nil
+}
+
+// simpleJSONPointTime is the time of a datapoint, of any kind of series,
+// marshalled as an epoch timestamp in units of Res, see
+// WithTimeResolution.
+type simpleJSONPointTime struct {
+	Time time.Time
+	Res  TimeResolution
+}
+
+func (t simpleJSONPointTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Res.epoch(t.Time))
+}
+
+// pointTime returns the time of a datapoint, as sent in responses.
+func (h *Handler) pointTime(t time.Time) simpleJSONPointTime {
+	return simpleJSONPointTime{Time: h.outputTime(t), Res: h.timeResolution}
+}
+
+// simpleJSONValue is a datapoint value. NaN and infinite values, which
+// cannot be represented in JSON, are marshalled as null.
+type simpleJSONValue float64
+
+func (v simpleJSONValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return []byte("null"), nil
+	}
+	return json.Marshal(f)
+}
+
+type simpleJSONDataPoint struct {
+	Value float64             `json:"value"`
+	Time  simpleJSONPointTime `json:"time"`
+	Null  bool                `json:"-"`
+}
+
+func (sjdp *simpleJSONDataPoint) MarshalJSON() ([]byte, error) {
+	var value interface{} = simpleJSONValue(sjdp.Value)
+	if sjdp.Null {
+		value = nil
+	}
+	out := [2]interface{}{value, sjdp.Time}
 	return json.Marshal(out)
 }
 
-func (sjd *simpleJSONDuration) UnmarshalJSON(injs []byte) error {
-	in := ""
-	err := json.Unmarshal(injs, &in)
+func (sjdp *simpleJSONDataPoint) UnmarshalJSON(injs []byte) error {
+	in := [2]*float64{}
+	err := json.Unmarshal(injs, &in)
+	if err != nil {
+		return err
+	}
+	if in[1] == nil {
+		return errors.New("datapoint has no time")
+	}
+	*sjdp = simpleJSONDataPoint{}
+	if in[0] == nil {
+		sjdp.Null = true
+	} else {
+		sjdp.Value = *in[0]
+	}
+	sjdp.Time = simpleJSONPointTime{Time: time.Unix(0, int64(*in[1])*1000000)}
+
+	return nil
+}
+
+type simpleJSONData struct {
+	Target     string                `json:"target"`
+	DataPoints []simpleJSONDataPoint `json:"datapoints"`
+	Fill       int                   `json:"fill,omitempty"`
+	Stack      string                `json:"stack,omitempty"`
+	Meta       *simpleJSONSeriesMeta `json:"meta,omitempty"`
+}
+
+type simpleJSONSeriesMeta struct {
+	Unit     string `json:"unit,omitempty"`
+	Decimals *int   `json:"decimals,omitempty"`
+}
+
+type simpleJSONTableColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+	Unit string `json:"unit,omitempty"`
+}
+
+type simpleJSONTableRow []interface{}
+
+type simpleJSONTypedCell struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+type simpleJSONTableData struct {
+	Type    string                  `json:"type"`
+	Columns []simpleJSONTableColumn `json:"columns"`
+	Rows    []simpleJSONTableRow    `json:"rows"`
+	Meta    *simpleJSONTableMeta    `json:"meta,omitempty"`
+}
+
+type simpleJSONTableMeta struct {
+	NextCursor string `json:"nextCursor"`
+}
+
+func (h *Handler) jsonTableQuery(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) (interface{}, error) {
+	release, err := h.acquireBackend(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args := TableQueryArguments{
+		QueryCommonArguments: QueryCommonArguments{
+			From:     time.Time(req.Range.From),
+			To:       time.Time(req.Range.To),
+			Filters:  req.filters(target),
+			Location: req.location,
+		},
+		Cursor: target.data().Cursor,
+		RefID:  target.RefID,
+		Hide:   target.Hide,
+	}
+	if args.Cursor == "" {
+		args.Cursor = req.cursor
+	}
+	if rq, ok := h.tableQuery.(RowTableQuerier); ok && req.out != nil {
+		defer release()
+		return h.jsonRowTableQuery(ctx, rq, req.out, target.Target, args)
+	}
+	var resp []TableColumn
+	var next string
+	if pq, ok := h.tableQuery.(PagedTableQuerier); ok {
+		resp, next, err = pq.GrafanaQueryTablePage(ctx, target.Target, args)
+	} else {
+		resp, err = h.tableQuery.GrafanaQueryTable(ctx, target.Target, args)
+	}
+	release()
+	if err != nil {
+		return nil, err
+	}
+
+	resp = append([]TableColumn(nil), resp...)
+	sort.SliceStable(resp, func(i, j int) bool { return resp[i].Order < resp[j].Order })
+
+	rowCount := 0
+	var cols []simpleJSONTableColumn
+	for i, cv := range resp {
+		var colType string
+		var dataLen int
+		switch data := cv.Data.(type) {
+		case TableNumberColumn:
+			colType = "number"
+			dataLen = len(data)
+		case TableStringColumn:
+			colType = "string"
+			dataLen = len(data)
+		case TableTimeColumn:
+			colType = "time"
+			dataLen = len(data)
+		case TableBoolColumn:
+			colType = "bool"
+			dataLen = len(data)
+		default:
+			return nil, errors.New("invlalid column type")
+		}
+
+		// All columns must have as many rows as the first.
+		if i == 0 {
+			rowCount = dataLen
+		}
+		if dataLen != rowCount {
+			return nil, fmt.Errorf("column %q has %d rows, expected %d", cv.Text, dataLen, rowCount)
+		}
+		cols = append(cols, simpleJSONTableColumn{Text: cv.Text, Type: colType, Unit: cv.Unit})
+	}
+	rows := make([]simpleJSONTableRow, rowCount)
+	for i := 0; i < rowCount; i++ {
+		rows[i] = make([]interface{}, len(resp))
+	}
+
+	// Footer rows start at body.
+	body := rowCount
+	if len(resp) > 0 && resp[0].Footer > 0 {
+		body -= resp[0].Footer
+		if body < 0 {
+			body = 0
+		}
+	}
+
+	for j := range resp {
+		switch data := resp[j].Data.(type) {
+		case TableNumberColumn:
+			// Non-finite values, such as the average of no rows, are
+			// sent as null.
+			for i := 0; i < rowCount; i++ {
+				rows[i][j] = simpleJSONValue(data[i])
+			}
+		case TableStringColumn:
+			for i := 0; i < rowCount; i++ {
+				rows[i][j] = data[i]
+			}
+		case TableTimeColumn:
+			for i := 0; i < rowCount; i++ {
+				rows[i][j] = data[i]
+			}
+		case TableBoolColumn:
+			for i := 0; i < rowCount; i++ {
+				rows[i][j] = data[i]
+			}
+		}
+		if cols[j].Type != "number" {
+			for i := body; i < rowCount; i++ {
+				rows[i][j] = nil
+			}
+		}
+	}
+
+	if h.sortTableByTime {
+		timeCol := -1
+		for j, c := range cols {
+			if c.Type != "time" {
+				continue
+			}
+			if timeCol != -1 {
+				timeCol = -1
+				break
+			}
+			timeCol = j
+		}
+		if timeCol != -1 {
+			sorted := rows[:body]
+			sort.SliceStable(sorted, func(i, j int) bool {
+				return sorted[i][timeCol].(time.Time).Before(sorted[j][timeCol].(time.Time))
+			})
+		}
+	}
+
+	if h.typedTableCells {
+		for i := range rows {
+			for j := range rows[i] {
+				rows[i][j] = simpleJSONTypedCell{Type: cols[j].Type, Value: rows[i][j]}
+			}
+		}
+	}
+
+	out := simpleJSONTableData{
+		Type:    "table",
+		Columns: cols,
+		Rows:    rows,
+	}
+	if next != "" {
+		out.Meta = &simpleJSONTableMeta{NextCursor: next}
+	}
+	return out, nil
+}
+
+// replaceInf replaces infinite values with the sentinels set by
+// WithInfSentinels, if any.
+func (h *Handler) replaceInf(v float64) float64 {
+	if !h.infSentinels {
+		return v
+	}
+	switch {
+	case math.IsInf(v, 1):
+		return h.posInf
+	case math.IsInf(v, -1):
+		return h.negInf
+	default:
+		return v
+	}
+}
+
+// querySeries queries the datapoints for a timeserie target, returning them
+// sorted, and downsampled, as configured.
+func (h *Handler) querySeries(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) ([]DataPoint, error) {
+	args := req.queryArguments(target)
+	fetch := func(ctx context.Context) ([]DataPoint, error) {
+		release, err := h.acquireBackend(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return h.querier(target.Target).GrafanaQuery(ctx, target.Target, args)
+	}
+
+	var resp []DataPoint
+	var err error
+	if h.cache != nil {
+		resp, err = h.cache.get(ctx, queryCacheKey(ctx, req, target.Target, args), fetch)
+	} else {
+		resp, err = fetch(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return h.processSeries(resp, args)
+}
+
+func (req *simpleJSONQuery) queryArguments(target simpleJSONTarget) QueryArguments {
+	return QueryArguments{
+		QueryCommonArguments: QueryCommonArguments{
+			From:     time.Time(req.Range.From),
+			To:       time.Time(req.Range.To),
+			Filters:  req.filters(target),
+			Location: req.location,
+		},
+		Interval:   time.Duration(req.Interval),
+		MaxDPs:     req.MaxDataPoints,
+		Downsample: target.data().Downsample,
+		RefID:      target.RefID,
+		Hide:       target.Hide,
+	}
+}
+
+// processSeries sorts, and downsamples, the datapoints of a series as
+// configured.
+func (h *Handler) processSeries(resp []DataPoint, args QueryArguments) ([]DataPoint, error) {
+	var err error
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Time.Before(resp[j].Time) })
+	if h.downsample != "" {
+		method := args.Downsample
+		if method == "" {
+			method = h.downsample
+		}
+		resp, err = downsample(resp, args.MaxDPs, method)
+		if err != nil {
+			return nil, &StatusError{Code: http.StatusBadRequest, Err: err}
+		}
+	}
+	if h.seriesDescending {
+		for i, j := 0, len(resp)-1; i < j; i, j = i+1, j-1 {
+			resp[i], resp[j] = resp[j], resp[i]
+		}
+	}
+
+	return resp, nil
+}
+
+func (h *Handler) jsonQuery(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) (interface{}, error) {
+	resp, err := h.querySeries(ctx, req, target)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	d, err := time.ParseDuration(in)
+	return h.seriesData(ctx, req, h.querier(target.Target), target.Target, resp)
+}
+
+// jsonMultiQuery answers a timeserie target using the MultiQuerier,
+// returning one result per series.
+func (h *Handler) jsonMultiQuery(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) ([]interface{}, error) {
+	args := req.queryArguments(target)
+	release, err := h.acquireBackend(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	series, err := h.multiQuery.GrafanaMultiQuery(ctx, target.Target, args)
+	release()
+	if err != nil {
+		return nil, err
 	}
 
-	*sjd = simpleJSONDuration(d)
+	out := []interface{}{}
+	for _, s := range series {
+		dps, err := h.processSeries(s.DataPoints, args)
+		if err != nil {
+			return nil, err
+		}
+		data, err := h.seriesData(ctx, req, h.multiQuery, s.Target, dps)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, data)
+	}
+	return out, nil
+}
 
-	return nil
+// seriesData builds the response for a single series, including any hints
+// provided by src.
+func (h *Handler) seriesData(ctx context.Context, req simpleJSONQuery, src interface{}, name string, resp []DataPoint) (interface{}, error) {
+	// A nil or empty response is sent as an empty datapoints array, never null.
+	out := simpleJSONData{Target: name, DataPoints: []simpleJSONDataPoint{}}
+	for _, v := range resp {
+		out.DataPoints = append(out.DataPoints, simpleJSONDataPoint{
+			Time:  h.pointTime(v.Time),
+			Value: h.replaceInf(v.Value),
+			Null:  v.Null,
+		})
+	}
+
+	var maxAge time.Duration
+	if sh, ok := src.(SeriesHinter); ok {
+		hints, err := sh.GrafanaSeriesHints(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		out.Fill = hints.Fill
+		out.Stack = hints.Stack
+		if hints.Unit != "" || hints.Decimals != nil {
+			out.Meta = &simpleJSONSeriesMeta{Unit: hints.Unit, Decimals: hints.Decimals}
+		}
+		maxAge = hints.MaxAge
+	}
+	req.maxAge.observe(maxAge)
+
+	return out, nil
 }
 
-type simpleJSONRawRange struct {
-	From string `json:"from"`
-	To   string `json:"to"`
+// responseMaxAge tracks the shortest MaxAge of the series in a response.
+// A series with no MaxAge prevents the response being cached.
+type responseMaxAge struct {
+	d       time.Duration
+	set     bool
+	noCache bool
 }
 
-type simpleJSONRange struct {
-	From simpleJSONTime     `json:"from"`
-	To   simpleJSONTime     `json:"to"`
-	Raw  simpleJSONRawRange `json:"raw"`
+func (m *responseMaxAge) observe(d time.Duration) {
+	switch {
+	case m == nil:
+	case d <= 0:
+		m.noCache = true
+	case !m.set || d < m.d:
+		m.d = d
+		m.set = true
+	}
 }
 
-type simpleJSONTarget struct {
-	Target string `json:"target"`
-	RefID  string `json:"refId"`
-	Hide   bool   `json:"hide"`
-	Type   string `json:"type"`
+// setHeader sets the Cache-Control header of the response, if every series
+// declared a MaxAge.
+func (m *responseMaxAge) setHeader(w http.ResponseWriter) {
+	if !m.set || m.noCache {
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(m.d/time.Second)))
 }
 
-/*
-{
-  "panelId": 1,
-  "range": {
-    "from": "2016-10-31T06:33:44.866Z",
-    "to": "2016-10-31T12:33:44.866Z",
-    "raw": {
-      "from": "now-6h",
-      "to": "now"
-    }
-  },
-  "rangeRaw": {
-    "from": "now-6h",
-    "to": "now"
-  },
-  "interval": "30s",
-  "intervalMs": 30000,
-  "targets": [
-    { "target": "upper_50", refId: "A" , "hide": false. "type"; "timeserie"},
-    { "target": "upper_75", refId: "B" }
-  ],
-  "format": "json",
-  "maxDataPoints": 550
+type simpleJSONLabeledDataPoint struct {
+	Value  simpleJSONValue     `json:"value"`
+	Time   simpleJSONPointTime `json:"time"`
+	Labels map[string]string   `json:"labels,omitempty"`
 }
-*/
 
-type simpleJSONQuery struct {
-	PanelID       int                `json:"panelId"`
-	Range         simpleJSONRange    `json:"range"`
-	RangeRaw      simpleJSONRawRange `json:"rangeRaw"`
-	Interval      simpleJSONDuration `json:"interval"`
-	IntervalMS    int                `json:"intervalMs"`
-	Targets       []simpleJSONTarget `json:"targets"`
-	Format        string             `json:"format"`
-	MaxDataPoints int                `json:"maxDataPoints"`
-	AdhocFilters  []QueryAdhocFilter `json:"adhocFilters"`
+type simpleJSONLabeledData struct {
+	Target     string                       `json:"target"`
+	DataPoints []simpleJSONLabeledDataPoint `json:"datapoints"`
 }
 
-/*
-[
-  {
-    "target":"upper_75", // The field being queried for
-    "datapoints":[
-      [622,1450754160000],  // Metric value as a float , unixtimestamp in milliseconds
-      [365,1450754220000]
-    ]
-  },
-  {
-    "target":"upper_90",
-    "datapoints":[
-      [861,1450754160000],
-      [767,1450754220000]
-    ]
-  }
-]
-*/
+// jsonLabeledQuery answers "labeled" targets, sending each datapoint as an
+// object that includes its labels, rather than a [value, time] pair.
+func (h *Handler) jsonLabeledQuery(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) (interface{}, error) {
+	resp, err := h.querySeries(ctx, req, target)
+	if err != nil {
+		return nil, err
+	}
 
-type simpleJSONPTime time.Time
+	out := simpleJSONLabeledData{Target: target.Target, DataPoints: []simpleJSONLabeledDataPoint{}}
+	for _, v := range resp {
+		value := simpleJSONValue(h.replaceInf(v.Value))
+		if v.Null {
+			// NaN is always sent as null.
+			value = simpleJSONValue(math.NaN())
+		}
+		out.DataPoints = append(out.DataPoints, simpleJSONLabeledDataPoint{
+			Time:   h.pointTime(v.Time),
+			Value:  value,
+			Labels: v.Labels,
+		})
+	}
 
-func (sjdpt *simpleJSONPTime) MarshalJSON() ([]byte, error) {
-	out := time.Time(*sjdpt).UnixNano() / 1000000
-	return json.Marshal(out)
+	return out, nil
 }
 
-func (sjdpt *simpleJSONPTime) UnmarshalJSON(injs []byte) error {
-	in := int64(0)
-	err := json.Unmarshal(injs, &in)
-	if err != nil {
-		return err
+// queryTarget runs the appropriate timeserie or table query for a single
+// target, applying any configured timeout. A target may result in several
+// entries in the response.
+func (h *Handler) queryTarget(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) ([]interface{}, error) {
+	if typ := target.queryType(); typ == "" || typ == "timeserie" {
+		if h.multiQuery != nil && !h.isSyntheticTarget(target.Target) {
+			return h.guardTarget(ctx, target, func(ctx context.Context) ([]interface{}, error) {
+				return h.jsonMultiQuery(ctx, req, target)
+			})
+		}
 	}
 
-	t := time.Unix(0, in*1000000)
+	return h.guardTarget(ctx, target, func(ctx context.Context) ([]interface{}, error) {
+		res, err := h.querySingleTarget(ctx, req, target)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{res}, nil
+	})
+}
 
-	*sjdpt = simpleJSONPTime(t)
+// guardTarget runs query for target, applying any configured timeout and
+// target authorization.
+func (h *Handler) guardTarget(ctx context.Context, target simpleJSONTarget, query func(context.Context) ([]interface{}, error)) ([]interface{}, error) {
+	defer h.logSlow(time.Now(), "/query", target.Target)
 
-	return nil
-}
+	timeout := h.queryTimeout
+	if h.queryTimeoutFromTarget {
+		t, err := target.timeout()
+		if err != nil {
+			return nil, &StatusError{Code: http.StatusBadRequest, Err: err}
+		}
+		if t > 0 {
+			timeout = t
+		}
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-type simpleJSONDataPoint struct {
-	Value float64         `json:"value"`
-	Time  simpleJSONPTime `json:"time"`
+	if h.targetAuthorizer != nil {
+		if err := h.targetAuthorizer(ctx, target.Target); err != nil {
+			var serr *StatusError
+			if !errors.As(err, &serr) {
+				err = &StatusError{Code: http.StatusForbidden, Err: err}
+			}
+			return nil, err
+		}
+	}
+
+	res, err := query(ctx)
+	if err != nil && timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		var serr *StatusError
+		var cerr *Error
+		if !errors.As(err, &serr) && !errors.As(err, &cerr) {
+			err = &StatusError{Code: http.StatusGatewayTimeout, Err: err}
+		}
+	}
+	return res, err
 }
 
-func (sjdp *simpleJSONDataPoint) MarshalJSON() ([]byte, error) {
-	out := [2]float64{sjdp.Value, float64(time.Time(sjdp.Time).UnixNano() / 1000000)}
-	return json.Marshal(out)
+// querySingleTarget runs the query for a target that results in a single
+// entry in the response.
+func (h *Handler) querySingleTarget(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) (interface{}, error) {
+	switch target.queryType() {
+	case "", "timeserie":
+		if h.querier(target.Target) == nil {
+			return nil, &StatusError{Code: http.StatusBadRequest, Err: errors.New("timeserie query not implemented")}
+		}
+		return h.jsonQuery(ctx, req, target)
+	case "labeled":
+		if h.querier(target.Target) == nil {
+			return nil, &StatusError{Code: http.StatusBadRequest, Err: errors.New("timeserie query not implemented")}
+		}
+		return h.jsonLabeledQuery(ctx, req, target)
+	case "band":
+		if h.bandQuery == nil {
+			return nil, &StatusError{Code: http.StatusBadRequest, Err: errors.New("band query not implemented")}
+		}
+		return h.jsonBandQuery(ctx, req, target)
+	case "forecast":
+		if h.forecastQuery == nil {
+			return nil, &StatusError{Code: http.StatusBadRequest, Err: errors.New("forecast query not implemented")}
+		}
+		return h.jsonForecastQuery(ctx, req, target)
+	case "table":
+		if h.tableQuery == nil {
+			return nil, &StatusError{Code: http.StatusBadRequest, Err: errors.New("table query not implemented")}
+		}
+		return h.jsonTableQuery(ctx, req, target)
+	default:
+		return nil, &StatusError{Code: http.StatusBadRequest, Err: errors.New("unknown query type, timeserie, labeled, band, forecast or table")}
+	}
 }
 
-func (sjdp *simpleJSONDataPoint) UnmarshalJSON(injs []byte) error {
-	in := [2]float64{}
-	err := json.Unmarshal(injs, &in)
+// HandleQuery hands the /query endpoint, calling the appropriate timeserie
+// or table handler.
+func (h *Handler) HandleQuery(w http.ResponseWriter, r *http.Request) {
+	if h.query == nil && h.multiQuery == nil && h.bandQuery == nil && h.forecastQuery == nil && h.tableQuery == nil && !h.synthetic {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+
+	req := simpleJSONQuery{}
+	if h.batchRequests {
+		var raw json.RawMessage
+		if err := h.decodeRequest(w, r, &raw); err != nil {
+			h.writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if bs := bytes.TrimSpace(raw); len(bs) > 0 && bs[0] == '[' {
+			h.batchQuery(w, r, bs)
+			return
+		}
+		if err := json.Unmarshal(raw, &req); err != nil {
+			h.writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	} else if err := h.decodeRequest(w, r, &req); err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.prepareQuery(r, &req); err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if h.targetsHeader {
+		w.Header().Set(TargetsHeader, strings.Join(req.targetNames(), ","))
+	}
+
+	if _, ok := h.tableQuery.(RowTableQuerier); h.streamQueries || (ok && req.hasTableTarget()) {
+		h.streamQuery(w, r, req)
+		return
+	}
+
+	req.maxAge = &responseMaxAge{}
+	out, err := h.runQuery(ctx, req)
 	if err != nil {
-		return err
+		h.writeError(w, r, err, http.StatusInternalServerError)
+		return
 	}
-	*sjdp = simpleJSONDataPoint{}
-	sjdp.Value = in[0]
-	sjdp.Time = simpleJSONPTime(time.Unix(0, int64(in[1])*1000000))
 
-	return nil
+	bs, err := h.marshal(out)
+	if err != nil {
+		h.writeError(w, r, err, 500)
+		return
+	}
+
+	req.maxAge.setHeader(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
 }
 
-type simpleJSONData struct {
-	Target     string                `json:"target"`
-	DataPoints []simpleJSONDataPoint `json:"datapoints"`
+// WithMaxAdhocFilters rejects queries with more than n adhoc filters, with
+// status 400 Bad Request. A limit of 0, the default, leaves the number of
+// filters unlimited; negative limits are an error.
+func WithMaxAdhocFilters(n int) Opt {
+	return func(sjc *Handler) error {
+		if n < 0 {
+			return fmt.Errorf("maximum adhoc filters must not be negative, got %d", n)
+		}
+		sjc.maxAdhocFilters = n
+		return nil
+	}
 }
 
-type simpleJSONTableColumn struct {
-	Text string `json:"text"`
-	Type string `json:"type"`
+// WithBatchRequests allows the /query endpoint to accept a JSON array of
+// query requests, as sent by proxies that coalesce requests. Each query is
+// run in turn, and the response is an array holding the response to each.
+func WithBatchRequests() Opt {
+	return func(sjc *Handler) error {
+		sjc.batchRequests = true
+		return nil
+	}
 }
 
-type simpleJSONTableRow []interface{}
+// batchQuery answers a batch of queries, encoded as a JSON array in bs.
+// The response is only written once all queries have completed, so
+// streaming options do not apply.
+func (h *Handler) batchQuery(w http.ResponseWriter, r *http.Request, bs []byte) {
+	var reqs []simpleJSONQuery
+	if err := json.Unmarshal(bs, &reqs); err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
 
-type simpleJSONTableData struct {
-	Type    string                  `json:"type"`
-	Columns []simpleJSONTableColumn `json:"columns"`
-	Rows    []simpleJSONTableRow    `json:"rows"`
-}
+	var targets []string
+	maxAge := &responseMaxAge{}
+	out := make([][]interface{}, len(reqs))
+	for i := range reqs {
+		reqs[i].maxAge = maxAge
+		if err := h.prepareQuery(r, &reqs[i]); err != nil {
+			h.writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		targets = append(targets, reqs[i].targetNames()...)
 
-func (h *Handler) jsonTableQuery(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) (interface{}, error) {
-	resp, err := h.tableQuery.GrafanaQueryTable(
-		ctx,
-		target.Target,
-		TableQueryArguments{
-			QueryCommonArguments: QueryCommonArguments{
-				From:    time.Time(req.Range.From),
-				To:      time.Time(req.Range.To),
-				Filters: req.AdhocFilters,
-			},
-		},
-	)
+		res, err := h.runQuery(r.Context(), reqs[i])
+		if err != nil {
+			h.writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		out[i] = res
+	}
+	if h.targetsHeader {
+		w.Header().Set(TargetsHeader, strings.Join(targets, ","))
+	}
+
+	resp, err := h.marshal(out)
 	if err != nil {
-		return nil, err
+		h.writeError(w, r, err, 500)
+		return
 	}
 
-	rowCount := 0
-	var cols []simpleJSONTableColumn
-	for _, cv := range resp {
-		var colType string
-		var dataLen int
-		switch data := cv.Data.(type) {
-		case TableNumberColumn:
-			colType = "number"
-			dataLen = len(data)
-		case TableStringColumn:
-			colType = "string"
-			dataLen = len(data)
-		case TableTimeColumn:
-			colType = "time"
-			dataLen = len(data)
-		default:
-			return nil, errors.New("invlalid column type")
-		}
+	maxAge.setHeader(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
 
-		if rowCount == 0 {
-			rowCount = dataLen
+// prepareQuery resolves the timezone and range of a decoded query, and
+// applies any query rewriter and hidden target filtering.
+func (h *Handler) prepareQuery(r *http.Request, req *simpleJSONQuery) error {
+	if h.maxAdhocFilters > 0 {
+		n := len(req.AdhocFilters) + len(req.AltAdhocFilters)
+		for _, t := range req.Targets {
+			n += len(t.AdhocFilters)
 		}
-		if dataLen != rowCount {
-			return nil, errors.New("all columns must be of equal length")
+		if n > h.maxAdhocFilters {
+			return &StatusError{Code: http.StatusBadRequest, Err: fmt.Errorf("too many adhoc filters, %d exceeds the maximum of %d", n, h.maxAdhocFilters)}
 		}
-		cols = append(cols, simpleJSONTableColumn{Text: cv.Text, Type: colType})
 	}
-	rows := make([]simpleJSONTableRow, rowCount)
-	for i := 0; i < rowCount; i++ {
-		rows[i] = make([]interface{}, len(resp))
+
+	loc, err := parseTimezone(req.Timezone)
+	if err != nil {
+		return err
+	}
+	req.location = loc
+	req.cursor = r.URL.Query().Get("cursor")
+
+	if err := h.resolveRange(&req.Range, req.RangeRaw, req.location); err != nil {
+		return err
+	}
+
+	if h.queryRewriter != nil {
+		qr := req.queryRequest()
+		if err := h.queryRewriter(qr); err != nil {
+			return err
+		}
+		req.applyQueryRequest(qr)
+	}
+
+	if h.skipHidden {
+		visible := req.Targets[:0]
+		for _, t := range req.Targets {
+			if !t.Hide {
+				visible = append(visible, t)
+			}
+		}
+		req.Targets = visible
 	}
 
-	for j := range resp {
-		switch data := resp[j].Data.(type) {
-		case TableNumberColumn:
-			for i := 0; i < rowCount; i++ {
-				rows[i][j] = data[i]
-			}
-		case TableStringColumn:
-			for i := 0; i < rowCount; i++ {
-				rows[i][j] = data[i]
+	h.logRequestf("query, targets: %q, from: %v, to: %v", req.targetNames(), time.Time(req.Range.From), time.Time(req.Range.To))
+	return nil
+}
+
+// runQuery queries each of the request's targets in turn, returning the
+// complete response.
+func (h *Handler) runQuery(ctx context.Context, req simpleJSONQuery) ([]interface{}, error) {
+	var out []interface{}
+	var firstErr error
+	failed := 0
+	for _, target := range req.Targets {
+		res, err := h.queryTarget(ctx, req, target)
+		if err != nil {
+			if !h.partialResults {
+				return nil, err
 			}
-		case TableTimeColumn:
-			for i := 0; i < rowCount; i++ {
-				rows[i][j] = data[i]
+			h.omitTarget(target.Target, err)
+			if firstErr == nil {
+				firstErr = err
 			}
+			failed++
+			continue
 		}
+		out = append(out, res...)
+	}
+	if failed > 0 && failed == len(req.Targets) {
+		return nil, firstErr
 	}
+	if h.sortSeriesByLast {
+		h.sortSeriesByLastValue(out)
+	}
+	return out, nil
+}
 
-	return simpleJSONTableData{
-		Type:    "table",
-		Columns: cols,
-		Rows:    rows,
-	}, nil
+// WithPartialResults omits targets whose query fails from the response,
+// rather than failing the whole request, so that one broken target does
+// not blank a panel. Failures are logged, and recorded if WithErrorLog has
+// been used. If every target fails, the first error is returned as usual.
+func WithPartialResults() Opt {
+	return func(sjc *Handler) error {
+		sjc.partialResults = true
+		return nil
+	}
 }
 
-func (h *Handler) jsonQuery(ctx context.Context, req simpleJSONQuery, target simpleJSONTarget) (interface{}, error) {
-	resp, err := h.query.GrafanaQuery(
-		ctx,
-		target.Target,
-		QueryArguments{
-			QueryCommonArguments: QueryCommonArguments{
-				From:    time.Time(req.Range.From),
-				To:      time.Time(req.Range.To),
-				Filters: req.AdhocFilters,
-			},
-			Interval: time.Duration(req.Interval),
-			MaxDPs:   req.MaxDataPoints,
-		})
-	if err != nil {
-		return nil, err
+// omitTarget logs err, the reason target is omitted from a partial result.
+func (h *Handler) omitTarget(target string, err error) {
+	if h.errorLog != nil {
+		h.errorLog.record("/query", err)
 	}
+	h.logf("omitting target %q from query response, %v", target, err)
+}
 
-	sort.Slice(resp, func(i, j int) bool { return resp[i].Time.Before(resp[j].Time) })
-	out := simpleJSONData{Target: target.Target}
-	for _, v := range resp {
-		out.DataPoints = append(out.DataPoints, simpleJSONDataPoint{
-			Time:  simpleJSONPTime(v.Time),
-			Value: v.Value,
-		})
+func (req simpleJSONQuery) targetNames() []string {
+	var targets []string
+	for _, t := range req.Targets {
+		targets = append(targets, t.Target)
 	}
+	return targets
+}
 
-	return out, nil
+// writeStreamOpen starts a streamed array, inside any configured envelope.
+func (h *Handler) writeStreamOpen(w io.Writer) {
+	if h.envelope != "" {
+		key, _ := h.encode(h.envelope)
+		w.Write([]byte("{"))
+		w.Write(key)
+		w.Write([]byte(":"))
+	}
+	w.Write([]byte("["))
 }
 
-// HandleQuery hands the /query endpoint, calling the appropriate timeserie
-// or table handler.
-func (h *Handler) HandleQuery(w http.ResponseWriter, r *http.Request) {
-	if h.query == nil && h.tableQuery == nil {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+// queryOutput writes the entries of a query response as they become
+// available. Entries are held back until the response is started, so
+// that errors that occur before then can still be reported to the client.
+type queryOutput struct {
+	h       *Handler
+	w       http.ResponseWriter
+	pending [][]byte
+	started bool
+	entries int
+}
+
+// add writes an encoded entry, or holds it if the response has not been
+// started.
+func (o *queryOutput) add(bs []byte) {
+	if !o.started {
+		o.pending = append(o.pending, bs)
 		return
 	}
+	o.next().Write(bs)
+}
 
-	ctx := r.Context()
-
-	req := simpleJSONQuery{}
-	dec := json.NewDecoder(r.Body)
-	if err := dec.Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+// start writes the opening of the response, and any held entries.
+func (o *queryOutput) start() {
+	if o.started {
 		return
 	}
+	o.started = true
+	o.w.Header().Set("Content-Type", "application/json")
+	o.h.writeStreamOpen(o.w)
+	for _, bs := range o.pending {
+		o.next().Write(bs)
+	}
+	o.pending = nil
+}
 
-	var err error
-	var out []interface{}
+// next starts the response if need be, and returns the writer for the
+// next entry.
+func (o *queryOutput) next() io.Writer {
+	o.start()
+	if o.entries > 0 {
+		o.w.Write([]byte(","))
+	}
+	o.entries++
+	return o.w
+}
+
+func (o *queryOutput) flush() {
+	if f, ok := o.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close completes the response.
+func (o *queryOutput) close() {
+	o.start()
+	o.w.Write([]byte("]"))
+	if o.h.envelope != "" {
+		o.w.Write([]byte("}"))
+	}
+	o.flush()
+}
+
+// streamQuery writes the response incrementally. With WithStreamingQueries
+// the result of each target is written as soon as it is available,
+// flushing after each so that data is not held by buffering proxies.
+// Otherwise only entries written by a RowTableQuerier are streamed. Errors
+// that occur once data has been written cannot be reported to the client,
+// they are logged and the response is truncated.
+func (h *Handler) streamQuery(w http.ResponseWriter, r *http.Request, req simpleJSONQuery) {
+	ctx := r.Context()
+	out := &queryOutput{h: h, w: w}
+	req.out = out
+
+	var firstErr error
+	failed := 0
 	for _, target := range req.Targets {
-		var res interface{}
-		switch target.Type {
-		case "", "timeserie":
-			if h.query == nil {
-				http.Error(w, "timeserie query not implemented", http.StatusBadRequest)
-				return
+		entries := out.entries
+		res, err := h.queryTarget(ctx, req, target)
+		var parts [][]byte
+		for i := 0; err == nil && i < len(res); i++ {
+			if _, ok := res[i].(writtenEntry); ok {
+				continue
 			}
-			res, err = h.jsonQuery(ctx, req, target)
-		case "table":
-			if h.tableQuery == nil {
-				http.Error(w, "table query not implemented", http.StatusBadRequest)
-				return
+			var bs []byte
+			bs, err = h.encode(res[i])
+			parts = append(parts, bs)
+		}
+		if err == nil {
+			for _, bs := range parts {
+				out.add(bs)
 			}
-			res, err = h.jsonTableQuery(ctx, req, target)
-		default:
-			http.Error(w, "unknown query type, timeserie or table", 400)
-			return
+			if h.streamQueries {
+				if len(parts) > 0 {
+					out.start()
+				}
+				out.flush()
+			}
+			continue
 		}
-		if err != nil {
-			http.Error(w, err.Error(), 500)
+
+		// A target that has written part of its response cannot be omitted.
+		if h.partialResults && out.entries == entries {
+			h.omitTarget(target.Target, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			continue
+		}
+
+		if !out.started {
+			h.writeError(w, r, err, http.StatusInternalServerError)
 			return
 		}
-		out = append(out, res)
+		if h.errorLog != nil {
+			h.errorLog.record(r.URL.Path, err)
+		}
+		h.logf("aborted streamed response to %s, %v", r.URL.Path, err)
+		return
 	}
 
-	bs, err := json.Marshal(out)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	if failed > 0 && failed == len(req.Targets) && !out.started {
+		h.writeError(w, r, firstErr, http.StatusInternalServerError)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(bs)
+	out.close()
 }
 
 /*
@@ -654,10 +2640,15 @@ type simpleJSONAnnotation struct {
 type simpleJSONAnnotationResponse struct {
 	ReqAnnotation simpleJSONAnnotation `json:"annotation"`
 	Time          simpleJSONPTime      `json:"time"`
+	TimeEnd       *simpleJSONPTime     `json:"timeEnd,omitempty"`
 	RegionID      int                  `json:"regionId,omitempty"`
 	Title         string               `json:"title"`
 	Text          string               `json:"text"`
-	Tags          []string             `json:"tags"`
+	Tags          interface{}          `json:"tags"`
+	Markdown      bool                 `json:"markdown,omitempty"`
+	Source        string               `json:"source,omitempty"`
+	IsRegion      bool                 `json:"isRegion,omitempty"`
+	Value         *float64             `json:"value,omitempty"`
 }
 
 type simpleJSONAnnotationsQuery struct {
@@ -666,7 +2657,49 @@ type simpleJSONAnnotationsQuery struct {
 	Annotation simpleJSONAnnotation `json:"annotation"`
 }
 
-// HandleAnnotations responds to the /annotation requests.
+// annotationTags returns the tags as sent in annotation responses, joined
+// into a string if WithAnnotationTagsAsString has been used.
+func (h *Handler) annotationTags(tags []string) interface{} {
+	if h.annotationTagSep == nil {
+		return tags
+	}
+	return strings.Join(tags, *h.annotationTagSep)
+}
+
+// NDJSONContentType is the content type of newline-delimited JSON.
+const NDJSONContentType = "application/x-ndjson"
+
+// acceptsNDJSON reports whether the client asked for newline-delimited JSON.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(part); err == nil && mt == NDJSONContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNDJSON writes each annotation as a JSON object on its own line. No
+// envelope is applied.
+func (h *Handler) writeNDJSON(w http.ResponseWriter, r *http.Request, anns []simpleJSONAnnotationResponse) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", NDJSONContentType)
+	for i := range anns {
+		bs, err := h.encode(&anns[i])
+		if err != nil {
+			h.logf("aborted streamed response to %s, %v", r.URL.Path, err)
+			return
+		}
+		w.Write(append(bs, '\n'))
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// HandleAnnotations responds to the /annotation requests. Annotations are
+// returned as a JSON array, or, if the request's Accept header includes
+// NDJSONContentType, as newline-delimited JSON, one annotation per line.
 func (h *Handler) HandleAnnotations(w http.ResponseWriter, r *http.Request) {
 	if h.annotations == nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusBadRequest)
@@ -681,12 +2714,24 @@ func (h *Handler) HandleAnnotations(w http.ResponseWriter, r *http.Request) {
 	}
 
 	req := simpleJSONAnnotationsQuery{}
-	dec := json.NewDecoder(r.Body)
-	if err := dec.Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := h.decodeRequest(w, r, &req); err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.resolveRange(&req.Range, req.RangeRaw, nil); err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
+	h.logRequestf("annotations, query: %q, from: %v, to: %v", req.Annotation.Query, time.Time(req.Range.From), time.Time(req.Range.To))
+	defer h.logSlow(time.Now(), "/annotations", req.Annotation.Query)
+
+	release, err := h.acquireBackend(ctx)
+	if err != nil {
+		h.writeError(w, r, err, http.StatusServiceUnavailable)
+		return
+	}
 	resp := []simpleJSONAnnotationResponse{}
 	anns, err := h.annotations.GrafanaAnnotations(
 		ctx,
@@ -697,10 +2742,26 @@ func (h *Handler) HandleAnnotations(w http.ResponseWriter, r *http.Request) {
 				To:   time.Time(req.Range.To),
 			},
 		})
+	release()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
+	if h.annotationTagFilter {
+		anns = filterAnnotationsByTags(anns, ParseAnnotationTagQuery(req.Annotation.Query))
+	}
+	if h.annotationText != nil {
+		anns = append([]Annotation(nil), anns...)
+		buf := &bytes.Buffer{}
+		for i := range anns {
+			buf.Reset()
+			if err := h.annotationText.Execute(buf, anns[i]); err != nil {
+				h.writeError(w, r, fmt.Errorf("rendering annotation text, %w", err), http.StatusInternalServerError)
+				return
+			}
+			anns[i].Text = buf.String()
+		}
+	}
 
 	regionID := 1
 	for i := range anns {
@@ -709,10 +2770,21 @@ func (h *Handler) HandleAnnotations(w http.ResponseWriter, r *http.Request) {
 			Time:          simpleJSONPTime(anns[i].Time),
 			Title:         anns[i].Title,
 			Text:          anns[i].Text,
-			Tags:          anns[i].Tags,
+			Tags:          h.annotationTags(anns[i].Tags),
+			Markdown:      anns[i].Markdown,
+			Source:        anns[i].Source,
+			Value:         anns[i].Value,
+		}
+		if !anns[i].TimeEnd.IsZero() && h.annotationRegionMode == AnnotationRegionSingle {
+			end := simpleJSONPTime(anns[i].TimeEnd)
+			startAnn.TimeEnd = &end
+			startAnn.IsRegion = true
+			resp = append(resp, startAnn)
+			continue
 		}
 		if !anns[i].TimeEnd.IsZero() {
 			startAnn.RegionID = regionID
+			startAnn.IsRegion = h.annotationIsRegion
 		}
 		resp = append(resp, startAnn)
 
@@ -722,17 +2794,32 @@ func (h *Handler) HandleAnnotations(w http.ResponseWriter, r *http.Request) {
 				Time:          simpleJSONPTime(anns[i].TimeEnd),
 				Title:         anns[i].Title,
 				Text:          anns[i].Text,
-				Tags:          anns[i].Tags,
+				Tags:          h.annotationTags(anns[i].Tags),
+				Markdown:      anns[i].Markdown,
+				Source:        anns[i].Source,
+				Value:         anns[i].Value,
 				RegionID:      regionID,
+				IsRegion:      h.annotationIsRegion,
+			}
+			if anns[i].EndTitle != "" {
+				endAnn.Title = anns[i].EndTitle
+			}
+			if anns[i].EndText != "" {
+				endAnn.Text = anns[i].EndText
 			}
 			resp = append(resp, endAnn)
 			regionID++
 		}
 	}
 
-	bs, err := json.Marshal(resp)
+	if acceptsNDJSON(r) {
+		h.writeNDJSON(w, r, resp)
+		return
+	}
+
+	bs, err := h.marshal(resp)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		h.writeError(w, r, err, 500)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -740,12 +2827,29 @@ func (h *Handler) HandleAnnotations(w http.ResponseWriter, r *http.Request) {
 }
 
 type simpleJSONSearchQuery struct {
-	Target string
+	Target   string
+	Type     string          `json:"type"`
+	Payload  json.RawMessage `json:"payload"`
+	Grouped  bool            `json:"grouped"`
+	Variable string          `json:"variable"`
+}
+
+type simpleJSONSearchOption struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+type simpleJSONSearchGroup struct {
+	Text     string                   `json:"text"`
+	Children []simpleJSONSearchOption `json:"children"`
 }
 
-// HandleSearch implements the /search endpoint.
+// HandleSearch implements the /search endpoint. If a SearcherV2 is
+// configured and the request sets "grouped", results are returned as
+// groups of text/value options, otherwise a flat list of strings is
+// returned, streamed if a StreamingSearcher is configured.
 func (h *Handler) HandleSearch(w http.ResponseWriter, r *http.Request) {
-	if h.search == nil {
+	if h.search == nil && h.searchV2 == nil && h.searchStream == nil && h.variableSearch == nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusBadRequest)
 		return
 	}
@@ -753,33 +2857,209 @@ func (h *Handler) HandleSearch(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	req := simpleJSONSearchQuery{}
-	dec := json.NewDecoder(r.Body)
-	if err := dec.Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := h.decodeRequest(w, r, &req); err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	h.logRequestf("search, target: %q", req.Target)
+	defer h.logSlow(time.Now(), "/search", req.Target)
+
+	isVariable := h.variableSearch != nil && req.Variable != ""
+	if h.searchStream != nil && !isVariable && (!req.Grouped || h.searchV2 == nil) {
+		h.streamSearch(w, r, req)
 		return
 	}
 
-	resp, err := h.search.GrafanaSearch(ctx, req.Target)
+	var resp interface{}
+	var err error
+	switch {
+	case isVariable:
+		resp, err = h.jsonVariableSearch(ctx, req)
+	case h.search == nil && h.searchV2 == nil:
+		err = &StatusError{Code: http.StatusBadRequest, Err: errors.New("search not implemented")}
+	case h.searchV2 != nil && (req.Grouped || h.search == nil):
+		resp, err = h.jsonSearchGrouped(ctx, req)
+	default:
+		resp, err = h.jsonSearch(ctx, req)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	bs, err := json.Marshal(resp)
+	bs, err := h.marshal(resp)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		h.writeError(w, r, err, 500)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(bs)
 }
 
+func (h *Handler) jsonSearch(ctx context.Context, req simpleJSONSearchQuery) (interface{}, error) {
+	var resp []string
+	var err error
+	if as, ok := h.search.(ArgumentSearcher); ok {
+		resp, err = as.GrafanaSearchArguments(ctx, req.Target, SearchArguments{Type: req.Type, Payload: req.Payload})
+	} else {
+		resp, err = h.search.GrafanaSearch(ctx, req.Target)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if h.searchTransform == nil {
+		return resp, nil
+	}
+
+	out := make([]string, len(resp))
+	for i := range resp {
+		out[i] = h.searchTransform(resp[i])
+	}
+	return out, nil
+}
+
+func (h *Handler) jsonVariableSearch(ctx context.Context, req simpleJSONSearchQuery) (interface{}, error) {
+	vals, err := h.variableSearch.GrafanaVariableValues(ctx, req.Variable, req.Target)
+	if err != nil {
+		return nil, err
+	}
+	if vals == nil {
+		vals = []string{}
+	}
+	return vals, nil
+}
+
+func (h *Handler) jsonSearchGrouped(ctx context.Context, req simpleJSONSearchQuery) (interface{}, error) {
+	groups, err := h.searchV2.GrafanaSearchGrouped(ctx, req.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	if !req.Grouped {
+		flat := []string{}
+		for _, g := range groups {
+			for _, c := range g.Children {
+				flat = append(flat, h.searchText(c))
+			}
+		}
+		return flat, nil
+	}
+
+	out := []simpleJSONSearchGroup{}
+	for _, g := range groups {
+		sg := simpleJSONSearchGroup{Text: g.Text, Children: []simpleJSONSearchOption{}}
+		for _, c := range g.Children {
+			sg.Children = append(sg.Children, simpleJSONSearchOption{Text: h.searchText(c), Value: c})
+		}
+		out = append(out, sg)
+	}
+	return out, nil
+}
+
+// searchText applies any transform set with WithSearchTransform.
+func (h *Handler) searchText(s string) string {
+	if h.searchTransform == nil {
+		return s
+	}
+	return h.searchTransform(s)
+}
+
 type simpleJSONQueryAdhocKey struct {
 	Type string `json:"type"`
 	Text string `json:"text"`
 }
 
-// HandleTagKeys implements the /tag-keys endpoint.
+// decodeRequest decodes the JSON request body into v, honouring
+// WithDecodeTimeout.
+func (h *Handler) decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if h.decodeTimeout <= 0 {
+		return json.NewDecoder(r.Body).Decode(v)
+	}
+
+	timeoutErr := &StatusError{Code: http.StatusRequestTimeout, Err: errors.New("timed out reading request body")}
+
+	// Where the connection allows it, a read deadline interrupts any
+	// blocked read of the body.
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Now().Add(h.decodeTimeout)); err == nil {
+		err := json.NewDecoder(r.Body).Decode(v)
+		var nerr net.Error
+		if errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &nerr) && nerr.Timeout()) {
+			// The deadline is left in place, so that the server's
+			// attempt to discard the rest of the body also fails,
+			// and the connection is closed.
+			w.Header().Set("Connection", "close")
+			return timeoutErr
+		}
+		rc.SetReadDeadline(time.Time{})
+		return err
+	}
+
+	// Otherwise the decode is abandoned on timeout. The body must not be
+	// closed here, as that would block on the outstanding read.
+	done := make(chan error, 1)
+	go func() {
+		done <- json.NewDecoder(r.Body).Decode(v)
+	}()
+
+	t := time.NewTimer(h.decodeTimeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		return timeoutErr
+	}
+}
+
+// marshal encodes v as JSON, honouring WithDisableHTMLEscape.
+func (h *Handler) marshal(v interface{}) ([]byte, error) {
+	if h.envelope != "" {
+		v = map[string]interface{}{h.envelope: v}
+	}
+	return h.encode(v)
+}
+
+// encode marshals v, honouring WithDisableHTMLEscape, but not any envelope.
+func (h *Handler) encode(v interface{}) ([]byte, error) {
+	if !h.noHTMLEscape {
+		return json.Marshal(v)
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// writeCacheableJSON writes the JSON in bs with an ETag derived from its
+// content, responding with 304 Not Modified if the request's If-None-Match
+// matches.
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, bs []byte) {
+	hash := fnv.New64a()
+	hash.Write(bs)
+	etag := fmt.Sprintf(`"%x"`, hash.Sum64())
+
+	w.Header().Set("ETag", etag)
+	for _, m := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		m = strings.TrimPrefix(strings.TrimSpace(m), "W/")
+		if m == etag || m == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
+
+// HandleTagKeys implements the /tag-keys endpoint. Responses carry an ETag
+// and honour If-None-Match.
 func (h *Handler) HandleTagKeys(w http.ResponseWriter, r *http.Request) {
 	if h.tags == nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
@@ -790,7 +3070,7 @@ func (h *Handler) HandleTagKeys(w http.ResponseWriter, r *http.Request) {
 
 	tags, err := h.tags.GrafanaAdhocFilterTags(ctx)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 	var allTags []simpleJSONQueryAdhocKey
@@ -801,20 +3081,20 @@ func (h *Handler) HandleTagKeys(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	bs, err := json.Marshal(allTags)
+	bs, err := h.marshal(allTags)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		h.writeError(w, r, err, 500)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(bs)
+	writeCacheableJSON(w, r, bs)
 }
 
 type simpleJSONTagValuesQuery struct {
 	Key string `json:"key"`
 }
 
-// HandleTagValues implements the /tag-values endpoint.
+// HandleTagValues implements the /tag-values endpoint. Responses carry an
+// ETag and honour If-None-Match.
 func (h *Handler) HandleTagValues(w http.ResponseWriter, r *http.Request) {
 	if h.tags == nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusBadRequest)
@@ -824,15 +3104,14 @@ func (h *Handler) HandleTagValues(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	req := simpleJSONTagValuesQuery{}
-	dec := json.NewDecoder(r.Body)
-	if err := dec.Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := h.decodeRequest(w, r, &req); err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
 	vals, err := h.tags.GrafanaAdhocFilterTagValues(ctx, req.Key)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
@@ -841,17 +3120,213 @@ func (h *Handler) HandleTagValues(w http.ResponseWriter, r *http.Request) {
 		allVals = append(allVals, val.tagValue())
 	}
 
-	bs, err := json.Marshal(allVals)
+	bs, err := h.marshal(allVals)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		h.writeError(w, r, err, 500)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(bs)
+	writeCacheableJSON(w, r, bs)
+}
+
+// Error can be returned by a data source to control both the HTTP status
+// code of the response and what the client is told. Status defaults to 500
+// Internal Server Error. Message is sent to the client, defaulting to the
+// status text, while Err, which may hold internal details, is only
+// recorded server side.
+type Error struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.status())
+	}
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) status() int {
+	if e.Status == 0 {
+		return http.StatusInternalServerError
+	}
+	return e.Status
+}
+
+// StatusError can be returned by a data source to control the HTTP status
+// code of the response. If RetryAfter is set a Retry-After header is
+// included, and Code defaults to 429 Too Many Requests.
+type StatusError struct {
+	Code       int
+	Err        error
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (e *StatusError) Error() string {
+	if e.Err == nil {
+		return http.StatusText(e.code())
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StatusError) code() int {
+	switch {
+	case e.Code != 0:
+		return e.Code
+	case e.RetryAfter > 0:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// RangeTooLargeError can be returned by a data source when the requested
+// range is too expensive to query. It is sent with status 422 as a JSON
+// object, e.g. {"message": "...", "maxRangeMs": 86400000}, so that a
+// client can retry with a smaller range; Grafana shows the message.
+type RangeTooLargeError struct {
+	MaxRange time.Duration
+	Err      error
+}
+
+// Error implements the error interface.
+func (e *RangeTooLargeError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("query range too large, the maximum is %v", e.MaxRange)
+}
+
+// Unwrap returns the underlying error.
+func (e *RangeTooLargeError) Unwrap() error {
+	return e.Err
+}
+
+type simpleJSONRangeError struct {
+	Message    string `json:"message"`
+	MaxRangeMS int64  `json:"maxRangeMs"`
+}
+
+// writeError responds with err, using the status code from any Error or
+// StatusError in the chain, or code otherwise. For an Error only its
+// Message is sent, a RangeTooLargeError is sent as JSON. The full error
+// is recorded if WithErrorLog has been used.
+func (h *Handler) writeError(w http.ResponseWriter, r *http.Request, err error, code int) {
+	msg := err.Error()
+	var body []byte
+	var serr *StatusError
+	var cerr *Error
+	var rerr *RangeTooLargeError
+	switch {
+	case errors.As(err, &rerr):
+		code = http.StatusUnprocessableEntity
+		body, _ = json.Marshal(simpleJSONRangeError{
+			Message:    rerr.Error(),
+			MaxRangeMS: rerr.MaxRange.Milliseconds(),
+		})
+	case errors.As(err, &cerr):
+		code = cerr.status()
+		msg = cerr.Message
+		if msg == "" {
+			msg = http.StatusText(code)
+		}
+	case errors.As(err, &serr):
+		code = serr.code()
+		if serr.RetryAfter > 0 {
+			secs := int64(math.Ceil(serr.RetryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+		}
+	}
+	if h.errorLog != nil {
+		h.errorLog.record(r.URL.Path, err)
+	}
+	h.logRequestf("error serving %s, status: %d, %v", r.URL.Path, code, err)
+	if body != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(body)
+		return
+	}
+	http.Error(w, msg, code)
+}
+
+// WithMiddleware wraps the handler in the given middleware. The first
+// middleware given is the outermost, and sees each request first. This
+// may be used more than once, later middleware is nested inside that
+// already added.
+func WithMiddleware(mws ...func(http.Handler) http.Handler) Opt {
+	return func(sjc *Handler) error {
+		sjc.middleware = append(sjc.middleware, mws...)
+		return nil
+	}
 }
 
 // ServeHTTP supports the http.Handler interface for a simplejson
 // handler.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.chain != nil {
+		h.chain.ServeHTTP(w, r)
+		return
+	}
+	h.serveHTTP(w, r)
+}
+
+func (h *Handler) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withIdentity(r)
+	if h.accessLog != nil {
+		rw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+		w = rw
+		defer h.accessLog.log(r, rw, time.Now())
+	}
+	if h.telemetry != nil {
+		_, endpoint := h.mux.Handler(r)
+		rw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+		w = rw
+		defer h.telemetry.observe(strings.TrimPrefix(endpoint, h.pathPrefix), rw, time.Now())
+	}
+	if h.gzip {
+		var done func() error
+		w, done = gzipResponse(w, r, h.gzipMinSize)
+		defer done()
+	}
+	if h.recovery {
+		defer h.recoverPanic(w, r)
+	}
+
+	if h.handleCORS(w, r) {
+		return
+	}
+	if h.requireJSON && h.isDataPath(r.URL.Path) {
+		mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mt != "application/json" {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	if name := r.Header.Get(ProfileHeader); name != "" && h.profiles != nil {
+		p, ok := h.profiles[name]
+		if !ok {
+			http.Error(w, "unknown profile", http.StatusNotFound)
+			return
+		}
+		http.StripPrefix(h.pathPrefix, p).ServeHTTP(w, r)
+		return
+	}
 	h.mux.ServeHTTP(w, r)
 }
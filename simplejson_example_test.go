@@ -55,6 +55,13 @@ func (GSJExample) GrafanaSearch(ctx context.Context, target string) ([]string, e
 	return []string{"example1", "example2", "example3"}, nil
 }
 
+func (GSJExample) GrafanaSearchGrouped(ctx context.Context, target string) ([]simplejson.SearchGroup, error) {
+	return []simplejson.SearchGroup{
+		{Text: "cpu", Children: []string{"cpu.user", "cpu.system"}},
+		{Text: "mem", Children: []string{"mem.free"}},
+	}, nil
+}
+
 func (GSJExample) GrafanaAdhocFilterTags(ctx context.Context) ([]simplejson.TagInfoer, error) {
 	return []simplejson.TagInfoer{
 		simplejson.TagStringKey("mykey"),
@@ -1,11 +1,26 @@
 package simplejson_test
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	simplejson "github.com/tcolgate/grafana-simple-json-go"
 )
@@ -49,6 +64,289 @@ func TestWithQuerier(t *testing.T) {
 	}
 }
 
+func TestWithNowFunc(t *testing.T) {
+	now := time.Date(2016, 10, 31, 12, 33, 44, 866000000, time.UTC)
+
+	tests := []struct {
+		from, to string
+		expect   string
+	}{
+		{
+			from:   "now-6h",
+			to:     "now",
+			expect: `[{"target":"upper_50","datapoints":[[1234,1477917219866],[1500,1477917224866]]}]`,
+		},
+		{
+			from:   "now-1d/d",
+			to:     "now-1d/d",
+			expect: `[{"target":"upper_50","datapoints":[[1234,1477871994999],[1500,1477871999999]]}]`,
+		},
+		{
+			from:   "now/h",
+			to:     "now-30m",
+			expect: `[{"target":"upper_50","datapoints":[[1234,1477915419866],[1500,1477915424866]]}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		gsj := simplejson.New(
+			simplejson.WithQuerier(GSJExample{}),
+			simplejson.WithNowFunc(func() time.Time { return now }),
+		)
+
+		q := fmt.Sprintf(`{
+				"rangeRaw": { "from": %q, "to": %q },
+				"interval": "30s",
+				"targets": [
+					{ "target": "upper_50", "refId": "A" }
+				]
+			}`, tt.from, tt.to)
+		reqBuf := bytes.NewBufferString(q)
+		req := httptest.NewRequest(http.MethodGet, "/query", reqBuf)
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res := w.Result()
+
+		buf := &bytes.Buffer{}
+		io.Copy(buf, res.Body)
+		if buf.String() != tt.expect {
+			t.Fatalf("%s to %s\nexpected: %q\ngot:%s", tt.from, tt.to, tt.expect, buf.String())
+		}
+	}
+}
+
+// recordingQuerier records the arguments of the last query it received.
+type recordingQuerier struct {
+	args *simplejson.QueryArguments
+}
+
+func (q recordingQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	*q.args = args
+	return nil, nil
+}
+
+func TestAdhocFilterKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+	}{
+		{
+			name: "adhocFilters",
+			req:  `{"targets": [{"target": "upper_50"}], "adhocFilters": [{"key": "host", "operator": "=", "value": "a"}]}`,
+		},
+		{
+			name: "adhoc_filters",
+			req:  `{"targets": [{"target": "upper_50"}], "adhoc_filters": [{"key": "host", "operator": "=", "value": "a"}]}`,
+		},
+		{
+			name: "target adhocFilters",
+			req:  `{"targets": [{"target": "upper_50", "adhocFilters": [{"key": "host", "operator": "=", "value": "a"}]}]}`,
+		},
+		{
+			name: "precedence",
+			req:  `{"targets": [{"target": "upper_50", "adhocFilters": [{"key": "host", "operator": "=", "value": "c"}]}], "adhocFilters": [{"key": "host", "operator": "=", "value": "a"}], "adhoc_filters": [{"key": "host", "operator": "=", "value": "b"}]}`,
+		},
+	}
+
+	expect := []simplejson.QueryAdhocFilter{{Key: "host", Operator: "=", Value: "a"}}
+	for _, tt := range tests {
+		args := simplejson.QueryArguments{}
+		gsj := simplejson.New(
+			simplejson.WithQuerier(recordingQuerier{&args}),
+		)
+
+		reqBuf := bytes.NewBufferString(tt.req)
+		req := httptest.NewRequest(http.MethodGet, "/query", reqBuf)
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+
+		if !reflect.DeepEqual(args.Filters, expect) {
+			t.Fatalf("%s\nexpected: %v\ngot:%v", tt.name, expect, args.Filters)
+		}
+	}
+}
+
+type filterQuerier map[string][]simplejson.QueryAdhocFilter
+
+func (q filterQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	q[target] = args.Filters
+	return nil, nil
+}
+
+type filterTableQuerier map[string][]simplejson.QueryAdhocFilter
+
+func (q filterTableQuerier) GrafanaQueryTable(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, error) {
+	q[target] = args.Filters
+	return nil, nil
+}
+
+func TestAdhocFiltersReachQueriers(t *testing.T) {
+	series := filterQuerier{}
+	table := filterTableQuerier{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(series),
+		simplejson.WithTableQuerier(table),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "s"}, {"target": "t", "type": "table"}], "adhocFilters": [
+		{"key": "host", "operator": "=", "value": "a"},
+		{"key": "dc", "operator": "!=", "value": "eu"}
+	]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	expect := []simplejson.QueryAdhocFilter{
+		{Key: "host", Operator: "=", Value: "a"},
+		{Key: "dc", Operator: "!=", Value: "eu"},
+	}
+	if !reflect.DeepEqual(series["s"], expect) {
+		t.Errorf("timeserie filters\nexpected: %v\ngot:%v", expect, series["s"])
+	}
+	if !reflect.DeepEqual(table["t"], expect) {
+		t.Errorf("table filters\nexpected: %v\ngot:%v", expect, table["t"])
+	}
+}
+
+func TestAdhocFiltersByRefID(t *testing.T) {
+	hostA := simplejson.QueryAdhocFilter{Key: "host", Operator: "=", Value: "a"}
+	hostB := simplejson.QueryAdhocFilter{Key: "host", Operator: "=", Value: "b"}
+
+	tests := []struct {
+		name   string
+		req    string
+		expect map[string][]simplejson.QueryAdhocFilter
+	}{
+		{
+			name:   "flat",
+			req:    `{"targets": [{"target": "x", "refId": "A"}, {"target": "y", "refId": "B"}], "adhocFilters": [{"key": "host", "operator": "=", "value": "a"}]}`,
+			expect: map[string][]simplejson.QueryAdhocFilter{"x": {hostA}, "y": {hostA}},
+		},
+		{
+			name: "keyed",
+			req: `{"targets": [{"target": "x", "refId": "A"}, {"target": "y", "refId": "B"}, {"target": "z", "refId": "C"}],
+				"adhocFilters": {"A": [{"key": "host", "operator": "=", "value": "a"}], "B": [{"key": "host", "operator": "=", "value": "b"}]}}`,
+			expect: map[string][]simplejson.QueryAdhocFilter{"x": {hostA}, "y": {hostB}, "z": nil},
+		},
+	}
+
+	for _, tt := range tests {
+		got := filterQuerier{}
+		gsj := simplejson.New(
+			simplejson.WithQuerier(got),
+		)
+
+		req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(tt.req))
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", tt.name, w.Code, w.Body.String())
+		}
+
+		if !reflect.DeepEqual(map[string][]simplejson.QueryAdhocFilter(got), tt.expect) {
+			t.Errorf("%s\nexpected: %v\ngot:%v", tt.name, tt.expect, got)
+		}
+	}
+}
+
+func TestWithQueryRewriter(t *testing.T) {
+	args := simplejson.QueryArguments{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(recordingQuerier{&args}),
+		simplejson.WithQueryRewriter(func(qr *simplejson.QueryRequest) error {
+			qr.Filters = append(qr.Filters, simplejson.QueryAdhocFilter{Key: "env", Operator: "=", Value: "prod"})
+			return nil
+		}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "upper_50"}], "adhocFilters": [{"key": "host", "operator": "=", "value": "a"}]}`)
+	req := httptest.NewRequest(http.MethodGet, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+
+	expect := []simplejson.QueryAdhocFilter{
+		{Key: "host", Operator: "=", Value: "a"},
+		{Key: "env", Operator: "=", Value: "prod"},
+	}
+	if !reflect.DeepEqual(args.Filters, expect) {
+		t.Fatalf("\nexpected: %v\ngot:%v", expect, args.Filters)
+	}
+}
+
+func TestWithQueryRewriter_Data(t *testing.T) {
+	args := simplejson.QueryArguments{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(recordingQuerier{&args}),
+		simplejson.WithDownsampling(simplejson.DownsampleLast),
+		simplejson.WithQueryRewriter(func(qr *simplejson.QueryRequest) error {
+			return nil
+		}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "upper_50", "data": {"downsample": "max"}}]}`)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+	if args.Downsample != simplejson.DownsampleMax {
+		t.Fatalf("expected target data to survive the rewriter, got downsample %v", args.Downsample)
+	}
+}
+
+func TestWithQueryRewriter_Error(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithQueryRewriter(func(qr *simplejson.QueryRequest) error {
+			return errors.New("bad target")
+		}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "upper_50"}]}`)
+	req := httptest.NewRequest(http.MethodGet, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+type rateLimitedQuerier struct{}
+
+func (rateLimitedQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	return nil, &simplejson.StatusError{
+		Err:        errors.New("rate limited"),
+		RetryAfter: 1500 * time.Millisecond,
+	}
+}
+
+func TestStatusErrorRetryAfter(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(rateLimitedQuerier{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "upper_50"}]}`)
+	req := httptest.NewRequest(http.MethodGet, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, res.StatusCode)
+	}
+	if ra := res.Header.Get("Retry-After"); ra != "2" {
+		t.Fatalf("expected Retry-After %q, got %q", "2", ra)
+	}
+}
+
 func TestWithTableQuerier(t *testing.T) {
 	gsj := simplejson.New(
 		simplejson.WithTableQuerier(GSJExample{}),
@@ -87,6 +385,76 @@ func TestWithTableQuerier(t *testing.T) {
 	}
 }
 
+func TestWithTypedTableCells(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTableQuerier(GSJExample{}),
+		simplejson.WithTypedTableCells(),
+	)
+
+	q := `{
+				"range": {
+					"from": "2016-10-31T06:33:44.866Z",
+					"to": "2016-10-31T12:33:44.866Z"
+				},
+				"targets": [
+					{ "target": "upper_50", "refId": "A", "type": "table"}
+				]
+			}`
+	reqBuf := bytes.NewBufferString(q)
+	req := httptest.NewRequest(http.MethodGet, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"type":"table","columns":[{"text":"Time","type":"time"},{"text":"SomeText","type":"string"},{"text":"Value","type":"number"}],"rows":[[{"type":"time","value":"2016-10-31T12:33:44.866Z"},{"type":"string","value":"blah"},{"type":"number","value":1}]]}]`
+
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+type unitTableQuerier struct{}
+
+func (unitTableQuerier) GrafanaQueryTable(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, error) {
+	return []simplejson.TableColumn{
+		{Text: "Time", Data: simplejson.TableTimeColumn{args.To}},
+		{Text: "Size", Data: simplejson.TableNumberColumn{1024.0}, Unit: "bytes"},
+	}, nil
+}
+
+func TestTableColumnUnit(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTableQuerier(unitTableQuerier{}),
+	)
+
+	q := `{
+				"range": {
+					"from": "2016-10-31T06:33:44.866Z",
+					"to": "2016-10-31T12:33:44.866Z"
+				},
+				"targets": [
+					{ "target": "upper_50", "refId": "A", "type": "table"}
+				]
+			}`
+	reqBuf := bytes.NewBufferString(q)
+	req := httptest.NewRequest(http.MethodGet, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"type":"table","columns":[{"text":"Time","type":"time"},{"text":"Size","type":"number","unit":"bytes"}],"rows":[["2016-10-31T12:33:44.866Z",1024]]}]`
+
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
 func TestWithAnnotator(t *testing.T) {
 	gsj := simplejson.New(
 		simplejson.WithAnnotator(GSJExample{}),
@@ -108,6 +476,80 @@ func TestWithAnnotator(t *testing.T) {
 	}
 }
 
+type markdownAnnotator struct{}
+
+func (markdownAnnotator) GrafanaAnnotations(ctx context.Context, query string, args simplejson.AnnotationsArguments) ([]simplejson.Annotation, error) {
+	return []simplejson.Annotation{
+		{
+			Time:     time.Unix(1234, 0),
+			Title:    "Deploy",
+			Text:     "**v1.2.3** deployed",
+			Markdown: true,
+		},
+	}, nil
+}
+
+func TestAnnotationMarkdown(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithAnnotator(markdownAnnotator{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": { "from": "2016-04-15T13:44:39.070Z", "to": "2016-04-15T14:44:39.070Z" }, "annotation": {"name":"query","query":"some query","enable":true,"iconColor":"#1234"}}`)
+	req := httptest.NewRequest(http.MethodGet, "/annotations", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"annotation":{"name":"query","query":"some query","enable":true,"iconColor":"#1234"},"time":1234000,"title":"Deploy","text":"**v1.2.3** deployed","tags":null,"markdown":true}]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+type fieldsAnnotator struct{}
+
+var deployNumber = 42.0
+
+func (fieldsAnnotator) GrafanaAnnotations(ctx context.Context, query string, args simplejson.AnnotationsArguments) ([]simplejson.Annotation, error) {
+	return []simplejson.Annotation{
+		{
+			Time:   time.Unix(1236, 0),
+			Title:  "Alert",
+			Text:   "disk full",
+			Source: "alertmanager",
+		},
+		{
+			Time:  time.Unix(1237, 0),
+			Title: "Deploy",
+			Text:  "build",
+			Value: &deployNumber,
+		},
+	}, nil
+}
+
+func TestAnnotationFields(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithAnnotator(fieldsAnnotator{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": { "from": "2016-04-15T13:44:39.070Z", "to": "2016-04-15T14:44:39.070Z" }, "annotation": {"name":"query","query":"some query","enable":true,"iconColor":"#1234"}}`)
+	req := httptest.NewRequest(http.MethodGet, "/annotations", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"annotation":{"name":"query","query":"some query","enable":true,"iconColor":"#1234"},"time":1236000,"title":"Alert","text":"disk full","tags":null,"source":"alertmanager"},{"annotation":{"name":"query","query":"some query","enable":true,"iconColor":"#1234"},"time":1237000,"title":"Deploy","text":"build","tags":null,"value":42}]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
 func TestWithSearcher(t *testing.T) {
 	gsj := simplejson.New(
 		simplejson.WithSearcher(GSJExample{}),
@@ -131,6 +573,41 @@ func TestWithSearcher(t *testing.T) {
 	}
 }
 
+func TestWithSearcherV2(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithSearcherV2(GSJExample{}),
+	)
+
+	tests := []struct {
+		req    string
+		expect string
+	}{
+		{
+			req:    `{"target": "upper_50", "grouped": true}`,
+			expect: `[{"text":"cpu","children":[{"text":"cpu.user","value":"cpu.user"},{"text":"cpu.system","value":"cpu.system"}]},{"text":"mem","children":[{"text":"mem.free","value":"mem.free"}]}]`,
+		},
+		{
+			req:    `{"target": "upper_50"}`,
+			expect: `["cpu.user","cpu.system","mem.free"]`,
+		},
+	}
+
+	for _, tt := range tests {
+		reqBuf := bytes.NewBufferString(tt.req)
+		req := httptest.NewRequest(http.MethodGet, "/search", reqBuf)
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res := w.Result()
+
+		buf := &bytes.Buffer{}
+		io.Copy(buf, res.Body)
+		if buf.String() != tt.expect {
+			t.Fatalf("\nexpected: %q\ngot:%s", tt.expect, buf.String())
+		}
+	}
+}
+
 func TestWithTagSearcher_Keys(t *testing.T) {
 	gsj := simplejson.New(
 		simplejson.WithTagSearcher(GSJExample{}),
@@ -172,3 +649,3379 @@ func TestWithTagSearcher_Values(t *testing.T) {
 		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
 	}
 }
+
+func TestWithRequireJSONContentType(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithRequireJSONContentType(),
+	)
+
+	tests := []struct {
+		contentType string
+		expect      int
+	}{
+		{contentType: "text/plain", expect: http.StatusUnsupportedMediaType},
+		{contentType: "", expect: http.StatusUnsupportedMediaType},
+		{contentType: "application/json; charset=utf-8", expect: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		reqBuf := bytes.NewBufferString(`{"target": "upper_50"}`)
+		req := httptest.NewRequest(http.MethodPost, "/search", reqBuf)
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != tt.expect {
+			t.Fatalf("content type %q: expected status %d, got %d", tt.contentType, tt.expect, res.StatusCode)
+		}
+	}
+}
+
+func TestWithErrorLog(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(rateLimitedQuerier{}),
+		simplejson.WithErrorLog(2),
+	)
+
+	for _, q := range []string{`{"targets": [`, `{"targets": [{"target": "a"}]}`, `{"targets": [{"target": "b"}]}`} {
+		req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(q))
+		gsj.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/errors", nil)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	var got []struct {
+		Time     time.Time `json:"time"`
+		Endpoint string    `json:"endpoint"`
+		Message  string    `json:"message"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatalf("failed decoding error log, %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 errors, got %d", len(got))
+	}
+	for _, e := range got {
+		if e.Endpoint != "/query" || e.Message != "rate limited" || e.Time.IsZero() {
+			t.Fatalf("unexpected error log entry %+v", e)
+		}
+	}
+}
+
+// deadlineQuerier records the time remaining on the context of each query
+// by target.
+type deadlineQuerier map[string]time.Duration
+
+func (q deadlineQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		q[target] = time.Until(dl)
+	}
+	return nil, nil
+}
+
+func TestWithQueryTimeoutFromTarget(t *testing.T) {
+	q := deadlineQuerier{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(q),
+		simplejson.WithQueryTimeout(time.Hour),
+		simplejson.WithQueryTimeoutFromTarget(),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [
+		{"target": "short", "data": {"timeout": "1s"}},
+		{"target": "millis", "data": {"timeout": 2000}},
+		{"target": "default"}
+	]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+
+	if d := q["short"]; d <= 0 || d > time.Second {
+		t.Fatalf("expected short deadline within 1s, got %v", d)
+	}
+	if d := q["millis"]; d <= time.Second || d > 2*time.Second {
+		t.Fatalf("expected millis deadline within 2s, got %v", d)
+	}
+	if d := q["default"]; d <= 2*time.Second {
+		t.Fatalf("expected default deadline of 1h, got %v", d)
+	}
+}
+
+func TestSparseSeries(t *testing.T) {
+	dps := []simplejson.DataPoint{
+		{Time: time.Unix(1, 0), Value: 1},
+		{Time: time.Unix(2, 0), Value: math.NaN()},
+		{Time: time.Unix(3, 0), Value: 3},
+		{Time: time.Unix(4, 0), Value: math.NaN()},
+	}
+
+	expect := []simplejson.DataPoint{
+		{Time: time.Unix(1, 0), Value: 1},
+		{Time: time.Unix(3, 0), Value: 3},
+	}
+	got := simplejson.SparseSeries(dps)
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("\nexpected: %v\ngot:%v", expect, got)
+	}
+
+	if got := simplejson.SparseSeries([]simplejson.DataPoint{{Value: math.NaN()}}); len(got) != 0 {
+		t.Fatalf("expected no datapoints, got %v", got)
+	}
+}
+
+type staticSearcher []string
+
+func (s staticSearcher) GrafanaSearch(ctx context.Context, target string) ([]string, error) {
+	return s, nil
+}
+
+func TestWithProfile(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithProfile("one", simplejson.WithSearcher(staticSearcher{"a1", "a2"})),
+		simplejson.WithProfile("two", simplejson.WithSearcher(staticSearcher{"b1"})),
+	)
+
+	tests := []struct {
+		path    string
+		profile string
+		expect  string
+	}{
+		{path: "/one/search", expect: `["a1","a2"]`},
+		{path: "/two/search", expect: `["b1"]`},
+		{path: "/search", profile: "one", expect: `["a1","a2"]`},
+		{path: "/search", profile: "two", expect: `["b1"]`},
+	}
+
+	for _, tt := range tests {
+		reqBuf := bytes.NewBufferString(`{"target": "upper_50"}`)
+		req := httptest.NewRequest(http.MethodPost, tt.path, reqBuf)
+		if tt.profile != "" {
+			req.Header.Set(simplejson.ProfileHeader, tt.profile)
+		}
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res := w.Result()
+
+		buf := &bytes.Buffer{}
+		io.Copy(buf, res.Body)
+		if buf.String() != tt.expect {
+			t.Fatalf("%s (%s)\nexpected: %q\ngot:%s", tt.path, tt.profile, tt.expect, buf.String())
+		}
+	}
+}
+
+func TestTagSearcherETag(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTagSearcher(GSJExample{}),
+	)
+
+	for _, tt := range []struct {
+		path string
+		body string
+	}{
+		{path: "/tag-keys", body: `{}`},
+		{path: "/tag-values", body: `{"key": "mykey"}`},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.body))
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res := w.Result()
+
+		etag := res.Header.Get("ETag")
+		if res.StatusCode != http.StatusOK || etag == "" {
+			t.Fatalf("%s: expected 200 with ETag, got %d %q", tt.path, res.StatusCode, etag)
+		}
+
+		req = httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.body))
+		req.Header.Set("If-None-Match", etag)
+		w = httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res = w.Result()
+
+		if res.StatusCode != http.StatusNotModified {
+			t.Fatalf("%s: expected status %d, got %d", tt.path, http.StatusNotModified, res.StatusCode)
+		}
+		if w.Body.Len() != 0 {
+			t.Fatalf("%s: expected empty body, got %q", tt.path, w.Body.String())
+		}
+
+		req = httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.body))
+		req.Header.Set("If-None-Match", `"stale"`)
+		w = httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		if res := w.Result(); res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status %d for stale etag, got %d", tt.path, http.StatusOK, res.StatusCode)
+		}
+	}
+}
+
+type rangeTagSearcher struct{}
+
+func (rangeTagSearcher) GrafanaAdhocFilterTags(ctx context.Context) ([]simplejson.TagInfoer, error) {
+	return []simplejson.TagInfoer{simplejson.TagStringKey("latency")}, nil
+}
+
+func (rangeTagSearcher) GrafanaAdhocFilterTagValues(ctx context.Context, key string) ([]simplejson.TagValuer, error) {
+	return []simplejson.TagValuer{
+		simplejson.RangeTagValuer{Min: 0, Max: 250.5},
+	}, nil
+}
+
+func TestRangeTagValuer(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTagSearcher(rangeTagSearcher{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"key": "latency"}`)
+	req := httptest.NewRequest(http.MethodPost, "/tag-values", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"text":"0 - 250.5","min":0,"max":250.5}]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+type mixedTagSearcher struct{}
+
+func (mixedTagSearcher) GrafanaAdhocFilterTags(ctx context.Context) ([]simplejson.TagInfoer, error) {
+	return []simplejson.TagInfoer{simplejson.TagStringKey("port")}, nil
+}
+
+func (mixedTagSearcher) GrafanaAdhocFilterTagValues(ctx context.Context, key string) ([]simplejson.TagValuer, error) {
+	return []simplejson.TagValuer{
+		simplejson.TagStringValue("any"),
+		simplejson.TagNumberValue(443),
+		simplejson.TagNumberValue(8080.5),
+	}, nil
+}
+
+func TestTagNumberValue(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTagSearcher(mixedTagSearcher{}),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/tag-values", bytes.NewBufferString(`{"key": "port"}`))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	expect := `[{"text":"any"},{"text":443},{"text":8080.5}]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, w.Body.String())
+	}
+}
+
+type siteTagSearcher struct{}
+
+func (siteTagSearcher) GrafanaAdhocFilterTags(ctx context.Context) ([]simplejson.TagInfoer, error) {
+	return []simplejson.TagInfoer{simplejson.TagStringKey("site")}, nil
+}
+
+func (siteTagSearcher) GrafanaAdhocFilterTagValues(ctx context.Context, key string) ([]simplejson.TagValuer, error) {
+	return []simplejson.TagValuer{
+		simplejson.TagTextValue{Text: "London", Value: "lon-1"},
+		simplejson.TagTextValue{Text: "Paris", Value: "par-2"},
+	}, nil
+}
+
+func TestTagTextValue(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTagSearcher(siteTagSearcher{}),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/tag-values", bytes.NewBufferString(`{"key": "site"}`))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	expect := `[{"text":"London","value":"lon-1"},{"text":"Paris","value":"par-2"}]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, w.Body.String())
+	}
+}
+
+type unsortedTableQuerier struct{}
+
+func (unsortedTableQuerier) GrafanaQueryTable(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, error) {
+	return []simplejson.TableColumn{
+		{Text: "Name", Data: simplejson.TableStringColumn{"c", "a", "b"}},
+		{Text: "Time", Data: simplejson.TableTimeColumn{time.Unix(3, 0).UTC(), time.Unix(1, 0).UTC(), time.Unix(2, 0).UTC()}},
+	}, nil
+}
+
+func TestWithSortTableByTime(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTableQuerier(unsortedTableQuerier{}),
+		simplejson.WithSortTableByTime(),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "upper_50", "type": "table"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"type":"table","columns":[{"text":"Name","type":"string"},{"text":"Time","type":"time"}],"rows":[["a","1970-01-01T00:00:01Z"],["b","1970-01-01T00:00:02Z"],["c","1970-01-01T00:00:03Z"]]}]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+func TestQuerierNilDataPoints(t *testing.T) {
+	args := simplejson.QueryArguments{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(recordingQuerier{&args}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "a"}, {"target": "b"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"target":"a","datapoints":[]},{"target":"b","datapoints":[]}]`
+	if res.StatusCode != http.StatusOK || buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%d %s", expect, res.StatusCode, buf.String())
+	}
+}
+
+type linkTableQuerier struct{}
+
+func (linkTableQuerier) GrafanaQueryTable(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, error) {
+	return []simplejson.TableColumn{
+		{Text: "Link", Data: simplejson.TableStringColumn{"<a href=\"/d?a=1&b=2\">dash</a>"}},
+	}, nil
+}
+
+func TestWithDisableHTMLEscape(t *testing.T) {
+	tests := []struct {
+		opts   []simplejson.Opt
+		expect string
+	}{
+		{
+			expect: `[{"type":"table","columns":[{"text":"Link","type":"string"}],"rows":[["\u003ca href=\"/d?a=1\u0026b=2\"\u003edash\u003c/a\u003e"]]}]`,
+		},
+		{
+			opts:   []simplejson.Opt{simplejson.WithDisableHTMLEscape()},
+			expect: `[{"type":"table","columns":[{"text":"Link","type":"string"}],"rows":[["<a href=\"/d?a=1&b=2\">dash</a>"]]}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		gsj := simplejson.New(append(tt.opts, simplejson.WithTableQuerier(linkTableQuerier{}))...)
+
+		reqBuf := bytes.NewBufferString(`{"targets": [{"target": "upper_50", "type": "table"}]}`)
+		req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res := w.Result()
+
+		buf := &bytes.Buffer{}
+		io.Copy(buf, res.Body)
+		if buf.String() != tt.expect {
+			t.Fatalf("\nexpected: %q\ngot:%s", tt.expect, buf.String())
+		}
+	}
+}
+
+func TestTableSummary(t *testing.T) {
+	cols := []simplejson.TableColumn{
+		{Text: "Name", Data: simplejson.TableStringColumn{"a", "b", "c"}},
+		{Text: "Value", Data: simplejson.TableNumberColumn{1, 2, 6}},
+	}
+
+	tests := []struct {
+		name   string
+		agg    simplejson.Aggregation
+		expect []simplejson.TableColumn
+	}{
+		{
+			name: "sum",
+			agg:  simplejson.AggregateSum,
+			expect: []simplejson.TableColumn{
+				{Text: "Name", Data: simplejson.TableStringColumn{"a", "b", "c", ""}, Footer: 1},
+				{Text: "Value", Data: simplejson.TableNumberColumn{1, 2, 6, 9}, Footer: 1},
+			},
+		},
+		{
+			name: "avg",
+			agg:  simplejson.AggregateAvg,
+			expect: []simplejson.TableColumn{
+				{Text: "Name", Data: simplejson.TableStringColumn{"a", "b", "c", ""}, Footer: 1},
+				{Text: "Value", Data: simplejson.TableNumberColumn{1, 2, 6, 3}, Footer: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := simplejson.TableSummary(cols, tt.agg)
+		if !reflect.DeepEqual(got, tt.expect) {
+			t.Fatalf("%s\nexpected: %v\ngot:%v", tt.name, tt.expect, got)
+		}
+	}
+
+	if len(cols[1].Data.(simplejson.TableNumberColumn)) != 3 {
+		t.Fatalf("TableSummary modified its input")
+	}
+}
+
+// summaryTableQuerier returns its table with a summary row.
+type summaryTableQuerier []simplejson.TableColumn
+
+func (q summaryTableQuerier) GrafanaQueryTable(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, error) {
+	return simplejson.TableSummary(q, simplejson.AggregateAvg), nil
+}
+
+func TestTableSummaryQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		cols   summaryTableQuerier
+		expect string
+	}{
+		{
+			name: "empty",
+			cols: summaryTableQuerier{
+				{Text: "Time", Data: simplejson.TableTimeColumn{}},
+				{Text: "Value", Data: simplejson.TableNumberColumn{}},
+			},
+			expect: `[{"type":"table","columns":[{"text":"Time","type":"time"},{"text":"Value","type":"number"}],"rows":[[null,null]]}]`,
+		},
+		{
+			name: "sorted",
+			cols: summaryTableQuerier{
+				{Text: "Time", Data: simplejson.TableTimeColumn{time.Unix(2, 0).UTC(), time.Unix(1, 0).UTC()}},
+				{Text: "Up", Data: simplejson.TableBoolColumn{true, false}},
+				{Text: "Value", Data: simplejson.TableNumberColumn{4, 2}},
+			},
+			expect: `[{"type":"table","columns":[{"text":"Time","type":"time"},{"text":"Up","type":"bool"},{"text":"Value","type":"number"}],"rows":[["1970-01-01T00:00:01Z",false,2],["1970-01-01T00:00:02Z",true,4],[null,null,3]]}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		gsj := simplejson.New(
+			simplejson.WithTableQuerier(tt.cols),
+			simplejson.WithSortTableByTime(),
+		)
+
+		reqBuf := bytes.NewBufferString(`{"targets": [{"target": "t", "type": "table"}]}`)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+		if w.Code != http.StatusOK || w.Body.String() != tt.expect {
+			t.Errorf("%s\nexpected: %s\ngot: %d %s", tt.name, tt.expect, w.Code, w.Body.String())
+		}
+	}
+}
+
+type hostVariableResolver map[string][]string
+
+func (vr hostVariableResolver) GrafanaVariable(ctx context.Context, target string, args simplejson.VariableArguments) ([]simplejson.VariableOption, error) {
+	var opts []simplejson.VariableOption
+	for _, dc := range args.Variables["dc"] {
+		for _, h := range vr[dc] {
+			opts = append(opts, simplejson.VariableOption{Text: dc + "/" + h, Value: h})
+		}
+	}
+	return opts, nil
+}
+
+func TestWithVariableResolver(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithVariableResolver(hostVariableResolver{
+			"eu": {"eu1", "eu2"},
+			"us": {"us1"},
+		}),
+	)
+
+	tests := []struct {
+		req    string
+		expect string
+	}{
+		{
+			req:    `{"payload": {"target": "hosts", "variables": {"dc": "eu"}}}`,
+			expect: `[{"__text":"eu/eu1","__value":"eu1"},{"__text":"eu/eu2","__value":"eu2"}]`,
+		},
+		{
+			req:    `{"payload": {"target": "hosts", "variables": {"dc": ["us", "eu"]}}}`,
+			expect: `[{"__text":"us/us1","__value":"us1"},{"__text":"eu/eu1","__value":"eu1"},{"__text":"eu/eu2","__value":"eu2"}]`,
+		},
+		{
+			req:    `{"payload": {"target": "hosts"}}`,
+			expect: `[]`,
+		},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/variable", bytes.NewBufferString(tt.req))
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res := w.Result()
+
+		buf := &bytes.Buffer{}
+		io.Copy(buf, res.Body)
+		if buf.String() != tt.expect {
+			t.Fatalf("\nexpected: %q\ngot:%s", tt.expect, buf.String())
+		}
+	}
+}
+
+type slowQuerier time.Duration
+
+func (q slowQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	time.Sleep(time.Duration(q))
+	return nil, nil
+}
+
+func TestWithSlowQueryLog(t *testing.T) {
+	logBuf := &bytes.Buffer{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(slowQuerier(20*time.Millisecond)),
+		simplejson.WithLogger(log.New(logBuf, "", 0)),
+		simplejson.WithSlowQueryLog(10*time.Millisecond),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "upper_50"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	gsj.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.Contains(logBuf.String(), `slow query, endpoint: /query, target: "upper_50"`) {
+		t.Fatalf("expected slow query log entry, got %q", logBuf.String())
+	}
+}
+
+func TestWithLoggerRequests(t *testing.T) {
+	logBuf := &bytes.Buffer{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(errQuerier{errors.New("backend unavailable")}),
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithLogger(log.New(logBuf, "", 0)),
+	)
+
+	reqs := []struct{ path, body string }{
+		{"/search", `{"target": "upper"}`},
+		{"/query", `{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "upper_50"}]}`},
+		{"/query", `{"targets": `},
+	}
+	for _, r := range reqs {
+		gsj.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, r.path, bytes.NewBufferString(r.body)))
+	}
+
+	for _, want := range []string{
+		`search, target: "upper"`,
+		`query, targets: ["upper_50"], from: 2016-10-31 06:33:44.866 +0000 UTC, to: 2016-10-31 12:33:44.866 +0000 UTC`,
+		`error serving /query, status: 500, backend unavailable`,
+		`error serving /query, status: 400, unexpected EOF`,
+	} {
+		if !strings.Contains(logBuf.String(), want) {
+			t.Errorf("expected %q in log, got %q", want, logBuf.String())
+		}
+	}
+}
+
+func TestWithSeriesOrder(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithSeriesOrder(false),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "upper_50"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"target":"upper_50","datapoints":[[1500,1477917224866],[1234,1477917219866]]}]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+type orderedTableQuerier struct{}
+
+func (orderedTableQuerier) GrafanaQueryTable(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, error) {
+	return []simplejson.TableColumn{
+		{Text: "Value", Data: simplejson.TableNumberColumn{1}, Order: 3},
+		{Text: "Name", Data: simplejson.TableStringColumn{"a"}, Order: 1},
+		{Text: "Host", Data: simplejson.TableStringColumn{"h"}, Order: 2},
+	}, nil
+}
+
+func TestTableColumnOrder(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTableQuerier(orderedTableQuerier{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "upper_50", "type": "table"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"type":"table","columns":[{"text":"Name","type":"string"},{"text":"Host","type":"string"},{"text":"Value","type":"number"}],"rows":[["a","h",1]]}]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func TestWithStreamingQueries(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithStreamingQueries(),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "upper_50"}, {"target": "upper_75"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	gsj.ServeHTTP(w, req)
+
+	expect := `[{"target":"upper_50","datapoints":[[1234,1477917219866],[1500,1477917224866]]},{"target":"upper_75","datapoints":[[1234,1477917219866],[1500,1477917224866]]}]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, w.Body.String())
+	}
+	if w.flushes < 2 {
+		t.Fatalf("expected a flush per target, got %d flushes", w.flushes)
+	}
+}
+
+func TestStaticAnnotator(t *testing.T) {
+	anns := []simplejson.Annotation{
+		{Time: time.Unix(100, 0), Title: "early", Tags: []string{"deploy"}},
+		{Time: time.Unix(200, 0), Title: "deploy web", Tags: []string{"deploy", "web"}},
+		{Time: time.Unix(250, 0), Title: "outage", Tags: []string{"outage"}},
+		{Time: time.Unix(150, 0), TimeEnd: time.Unix(210, 0), Title: "maintenance", Tags: []string{"deploy", "db"}},
+		{Time: time.Unix(400, 0), Title: "late", Tags: []string{"deploy"}},
+	}
+	sa := simplejson.StaticAnnotator(anns)
+
+	tests := []struct {
+		query  string
+		expect []string
+	}{
+		{query: "", expect: []string{"deploy web", "outage", "maintenance"}},
+		{query: "#deploy", expect: []string{"deploy web", "maintenance"}},
+		{query: "deploy, web", expect: []string{"deploy web"}},
+		{query: "missing", expect: nil},
+	}
+
+	for _, tt := range tests {
+		got, err := sa.GrafanaAnnotations(context.Background(), tt.query, simplejson.AnnotationsArguments{
+			QueryCommonArguments: simplejson.QueryCommonArguments{
+				From: time.Unix(190, 0),
+				To:   time.Unix(300, 0),
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+
+		var titles []string
+		for _, a := range got {
+			titles = append(titles, a.Title)
+		}
+		if !reflect.DeepEqual(titles, tt.expect) {
+			t.Fatalf("query %q\nexpected: %v\ngot:%v", tt.query, tt.expect, titles)
+		}
+	}
+}
+
+func TestWithTargetsHeader(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithTargetsHeader(),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "upper_50"}, {"target": "upper_75"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	expect := "upper_50,upper_75"
+	if got := res.Header.Get(simplejson.TargetsHeader); got != expect {
+		t.Fatalf("expected %s %q, got %q", simplejson.TargetsHeader, expect, got)
+	}
+}
+
+func TestWithSecondPrecisionRange(t *testing.T) {
+	args := simplejson.QueryArguments{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(recordingQuerier{&args}),
+		simplejson.WithSecondPrecisionRange(),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.999Z"}, "targets": [{"target": "upper_50"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	gsj.ServeHTTP(httptest.NewRecorder(), req)
+
+	from := time.Date(2016, 10, 31, 6, 33, 44, 0, time.UTC)
+	to := time.Date(2016, 10, 31, 12, 33, 44, 0, time.UTC)
+	if !args.From.Equal(from) || !args.To.Equal(to) {
+		t.Fatalf("expected range %v to %v, got %v to %v", from, to, args.From, args.To)
+	}
+}
+
+func TestWithSearchTransform(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithSearcher(staticSearcher{"cpu.user", "mem.free"}),
+		simplejson.WithSearchTransform(func(s string) string {
+			return strings.ReplaceAll(s, ".", "_")
+		}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"target": ""}`)
+	req := httptest.NewRequest(http.MethodPost, "/search", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `["cpu_user","mem_free"]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+type seriesQuerier []simplejson.DataPoint
+
+func (q seriesQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	return append([]simplejson.DataPoint(nil), q...), nil
+}
+
+func TestWithDownsampling(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(seriesQuerier{
+			{Time: time.Unix(1, 0), Value: 1},
+			{Time: time.Unix(2, 0), Value: 3},
+			{Time: time.Unix(3, 0), Value: 5},
+			{Time: time.Unix(4, 0), Value: 9},
+		}),
+		simplejson.WithDownsampling(simplejson.DownsampleLast),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"maxDataPoints": 2, "targets": [
+		{"target": "a", "data": {"downsample": "max"}},
+		{"target": "b", "data": {"downsample": "avg"}},
+		{"target": "c"}
+	]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"target":"a","datapoints":[[3,1000],[9,3000]]},{"target":"b","datapoints":[[2,1000],[7,3000]]},{"target":"c","datapoints":[[3,1000],[9,3000]]}]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+func TestConfig(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithQueryTimeout(5*time.Second),
+		simplejson.WithErrorLog(10),
+		simplejson.WithSeriesOrder(false),
+		simplejson.WithDownsampling(simplejson.DownsampleMax),
+		simplejson.WithProfile("b"),
+		simplejson.WithProfile("a"),
+	)
+
+	expect := simplejson.Config{
+		Querier:      true,
+		SkipHidden:   true,
+		Downsample:   simplejson.DownsampleMax,
+		ErrorLogSize: 10,
+		QueryTimeout: 5 * time.Second,
+		Profiles:     []string{"a", "b"},
+	}
+	if got := gsj.Config(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("\nexpected: %+v\ngot:%+v", expect, got)
+	}
+}
+
+func TestWithAnnotationIsRegion(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithAnnotator(GSJExample{}),
+		simplejson.WithAnnotationIsRegion(),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": { "from": "2016-04-15T13:44:39.070Z", "to": "2016-04-15T14:44:39.070Z" }, "annotation": {"name":"query","query":"some query","enable":true,"iconColor":"#1234"}}`)
+	req := httptest.NewRequest(http.MethodPost, "/annotations", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"annotation":{"name":"query","query":"some query","enable":true,"iconColor":"#1234"},"time":1234000,"title":"First Title","text":"First annotation","tags":null},{"annotation":{"name":"query","query":"some query","enable":true,"iconColor":"#1234"},"time":1235000,"regionId":1,"title":"Second Title","text":"Second annotation with range","tags":["outage"],"isRegion":true},{"annotation":{"name":"query","query":"some query","enable":true,"iconColor":"#1234"},"time":1237000,"regionId":1,"title":"Second Title","text":"Second annotation with range","tags":["outage"],"isRegion":true}]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+func TestWithAnnotationRegionMode(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithAnnotator(GSJExample{}),
+		simplejson.WithAnnotationRegionMode(simplejson.AnnotationRegionSingle),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": { "from": "2016-04-15T13:44:39.070Z", "to": "2016-04-15T14:44:39.070Z" }, "annotation": {"name":"query","query":"some query","enable":true,"iconColor":"#1234"}}`)
+	req := httptest.NewRequest(http.MethodPost, "/annotations", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+
+	expect := `[{"annotation":{"name":"query","query":"some query","enable":true,"iconColor":"#1234"},"time":1234000,"title":"First Title","text":"First annotation","tags":null},{"annotation":{"name":"query","query":"some query","enable":true,"iconColor":"#1234"},"time":1235000,"timeEnd":1237000,"title":"Second Title","text":"Second annotation with range","tags":["outage"],"isRegion":true}]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, w.Body.String())
+	}
+}
+
+func TestWithTargetAuthorizer(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithTargetAuthorizer(func(ctx context.Context, target string) error {
+			if target == "secret" {
+				return errors.New("access denied")
+			}
+			return nil
+		}),
+	)
+
+	tests := []struct {
+		req    string
+		expect int
+	}{
+		{req: `{"targets": [{"target": "upper_50"}]}`, expect: http.StatusOK},
+		{req: `{"targets": [{"target": "upper_50"}, {"target": "secret"}]}`, expect: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(tt.req))
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != tt.expect {
+			t.Fatalf("%s: expected status %d, got %d", tt.req, tt.expect, res.StatusCode)
+		}
+	}
+}
+
+type hintedQuerier struct {
+	GSJExample
+}
+
+func (hintedQuerier) GrafanaSeriesHints(ctx context.Context, target string) (simplejson.SeriesHints, error) {
+	switch target {
+	case "upper_50":
+		return simplejson.SeriesHints{Fill: 5, Stack: "A"}, nil
+	case "disk":
+		decimals := 0
+		return simplejson.SeriesHints{Unit: "bytes", Decimals: &decimals}, nil
+	default:
+		return simplejson.SeriesHints{}, nil
+	}
+}
+
+func TestSeriesHinter(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(hintedQuerier{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "upper_50"}, {"target": "upper_75"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"target":"upper_50","datapoints":[[1234,1477917219866],[1500,1477917224866]],"fill":5,"stack":"A"},{"target":"upper_75","datapoints":[[1234,1477917219866],[1500,1477917224866]]}]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+func TestSeriesMeta(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(hintedQuerier{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "disk"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+
+	expect := `[{"target":"disk","datapoints":[[1234,1477917219866],[1500,1477917224866]],"meta":{"unit":"bytes","decimals":0}}]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, w.Body.String())
+	}
+}
+
+func TestTargetsEncoding(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(recordingQuerier{&simplejson.QueryArguments{}}),
+		simplejson.WithTargetsHeader(),
+	)
+
+	tests := []struct {
+		req    string
+		expect string
+	}{
+		{
+			req:    `{"targets": [{"target": "a", "refId": "B"}, {"target": "b", "refId": "A"}]}`,
+			expect: "a,b",
+		},
+		{
+			req:    `{"targets": {"B": {"target": "b"}, "A": {"target": "a"}}}`,
+			expect: "a,b",
+		},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(tt.req))
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", tt.req, http.StatusOK, res.StatusCode)
+		}
+		if got := res.Header.Get(simplejson.TargetsHeader); got != tt.expect {
+			t.Fatalf("%s: expected targets %q, got %q", tt.req, tt.expect, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"targets": "a"}`))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for invalid targets, got %d", http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+func TestRate(t *testing.T) {
+	points := []simplejson.DataPoint{
+		{Time: time.Unix(10, 0), Value: 100},
+		{Time: time.Unix(0, 0), Value: 0},
+		{Time: time.Unix(15, 0), Value: 150},
+		{Time: time.Unix(45, 0), Value: 30}, // counter reset
+		{Time: time.Unix(47, 0), Value: 40},
+	}
+
+	expect := []simplejson.DataPoint{
+		{Time: time.Unix(10, 0), Value: 10},
+		{Time: time.Unix(15, 0), Value: 10},
+		{Time: time.Unix(47, 0), Value: 5},
+	}
+	if got := simplejson.Rate(points); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("\nexpected: %v\ngot:%v", expect, got)
+	}
+
+	if got := simplejson.Rate(points[:1]); len(got) != 0 {
+		t.Fatalf("expected no rates for a single point, got %v", got)
+	}
+
+	gap := []simplejson.DataPoint{
+		{Time: time.Unix(0, 0), Value: 100},
+		simplejson.NullDataPoint(time.Unix(1, 0)),
+		{Time: time.Unix(2, 0), Value: 102},
+		{Time: time.Unix(3, 0), Value: 104},
+	}
+	expect = []simplejson.DataPoint{
+		simplejson.NullDataPoint(time.Unix(1, 0)),
+		simplejson.NullDataPoint(time.Unix(2, 0)),
+		{Time: time.Unix(3, 0), Value: 2},
+	}
+	if got := simplejson.Rate(gap); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("\nexpected: %v\ngot:%v", expect, got)
+	}
+}
+
+// concurrencyQuerier tracks the maximum number of concurrent queries.
+type concurrencyQuerier struct {
+	mu        sync.Mutex
+	cur, max  int
+	sleepTime time.Duration
+}
+
+func (q *concurrencyQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	q.mu.Lock()
+	q.cur++
+	if q.cur > q.max {
+		q.max = q.cur
+	}
+	q.mu.Unlock()
+
+	time.Sleep(q.sleepTime)
+
+	q.mu.Lock()
+	q.cur--
+	q.mu.Unlock()
+	return nil, nil
+}
+
+func TestWithGlobalConcurrency(t *testing.T) {
+	q := &concurrencyQuerier{sleepTime: 10 * time.Millisecond}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(q),
+		simplejson.WithGlobalConcurrency(2),
+	)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"targets": [{"target": "a"}]}`))
+			gsj.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	if q.max != 2 {
+		t.Fatalf("expected at most 2 concurrent queries, got %d", q.max)
+	}
+}
+
+func TestWithGlobalConcurrencyTimeout(t *testing.T) {
+	q := &concurrencyQuerier{sleepTime: 100 * time.Millisecond}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(q),
+		simplejson.WithGlobalConcurrency(1),
+		simplejson.WithGlobalConcurrencyTimeout(10*time.Millisecond),
+	)
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"targets": [{"target": "a"}]}`))
+			w := httptest.NewRecorder()
+			gsj.ServeHTTP(w, req)
+			codes <- w.Code
+		}()
+	}
+
+	got := []int{<-codes, <-codes}
+	sort.Ints(got)
+	if expect := []int{http.StatusOK, http.StatusServiceUnavailable}; !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected statuses %v, got %v", expect, got)
+	}
+}
+
+func TestLabeledTarget(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(seriesQuerier{
+			{Time: time.Unix(1, 0), Value: 1, Labels: map[string]string{"event": "start"}},
+			{Time: time.Unix(2, 0), Value: 2},
+		}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "a", "type": "labeled"}, {"target": "b"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+
+	gsj.ServeHTTP(w, req)
+	res := w.Result()
+
+	buf := &bytes.Buffer{}
+	io.Copy(buf, res.Body)
+	expect := `[{"target":"a","datapoints":[{"value":1,"time":1000,"labels":{"event":"start"}},{"value":2,"time":2000}]},{"target":"b","datapoints":[[1,1000],[2,2000]]}]`
+	if buf.String() != expect {
+		t.Fatalf("\nexpected: %q\ngot:%s", expect, buf.String())
+	}
+}
+
+func TestInfDataPoints(t *testing.T) {
+	q := seriesQuerier{
+		{Time: time.Unix(1, 0), Value: math.Inf(1)},
+		{Time: time.Unix(2, 0), Value: math.Inf(-1)},
+		{Time: time.Unix(3, 0), Value: 3},
+	}
+
+	tests := []struct {
+		opts   []simplejson.Opt
+		expect string
+	}{
+		{
+			expect: `[{"target":"a","datapoints":[[null,1000],[null,2000],[3,3000]]}]`,
+		},
+		{
+			opts:   []simplejson.Opt{simplejson.WithInfSentinels(1e9, -1e9)},
+			expect: `[{"target":"a","datapoints":[[1000000000,1000],[-1000000000,2000],[3,3000]]}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		gsj := simplejson.New(append(tt.opts, simplejson.WithQuerier(q))...)
+
+		req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"targets": [{"target": "a"}]}`))
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		res := w.Result()
+
+		buf := &bytes.Buffer{}
+		io.Copy(buf, res.Body)
+		if !json.Valid(buf.Bytes()) || buf.String() != tt.expect {
+			t.Fatalf("\nexpected: %q\ngot:%s", tt.expect, buf.String())
+		}
+	}
+}
+
+func TestWithRequireJSONContentTypeMetrics(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithRequireJSONContentType(),
+		simplejson.WithMetrics(""),
+	)
+
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodGet, simplejson.DefaultMetricsPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected telemetry scrape to succeed, got status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(`{"target": "upper_50"}`)))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected status %d for search, got %d", http.StatusUnsupportedMediaType, w.Code)
+	}
+}
+
+func TestWithDecodeTimeout(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithDecodeTimeout(50*time.Millisecond),
+	)
+	srv := httptest.NewServer(gsj)
+	defer srv.Close()
+
+	// The client sends the start of the body, and then stalls.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed, %v", err)
+	}
+	defer conn.Close()
+	body := `{"target": "upper_50"}`
+	fmt.Fprintf(conn, "POST /search HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body[:5])
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading response failed, %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("expected status %d, got %d", http.StatusRequestTimeout, res.StatusCode)
+	}
+
+	client := &http.Client{Timeout: 3 * time.Second}
+	res, err = client.Post(srv.URL+"/search", "application/json", bytes.NewBufferString(`{"target": "upper_50"}`))
+	if err != nil {
+		t.Fatalf("request failed, %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+}
+
+type tenantTagSearcher struct{}
+
+func (tenantTagSearcher) GrafanaAdhocFilterTags(ctx context.Context) ([]simplejson.TagInfoer, error) {
+	keys := []simplejson.TagInfoer{simplejson.TagStringKey("host")}
+	if org, _ := simplejson.OrgIDFromContext(ctx); org == "2" {
+		keys = append(keys, simplejson.TagStringKey("tenant"))
+	}
+	if user, _ := simplejson.UserFromContext(ctx); user == "admin" {
+		keys = append(keys, simplejson.TagStringKey("secret"))
+	}
+	return keys, nil
+}
+
+func (tenantTagSearcher) GrafanaAdhocFilterTagValues(ctx context.Context, key string) ([]simplejson.TagValuer, error) {
+	return nil, nil
+}
+
+func TestTagKeysFromContext(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTagSearcher(tenantTagSearcher{}),
+	)
+
+	tests := []struct {
+		org, user string
+		ctxUser   string
+		expect    string
+	}{
+		{expect: `[{"type":"string","text":"host"}]`},
+		{org: "2", expect: `[{"type":"string","text":"host"},{"type":"string","text":"tenant"}]`},
+		{org: "1", user: "admin", expect: `[{"type":"string","text":"host"},{"type":"string","text":"secret"}]`},
+		{ctxUser: "admin", expect: `[{"type":"string","text":"host"},{"type":"string","text":"secret"}]`},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/tag-keys", bytes.NewBufferString(`{}`))
+		if tt.org != "" {
+			req.Header.Set(simplejson.GrafanaOrgIDHeader, tt.org)
+		}
+		if tt.user != "" {
+			req.Header.Set(simplejson.GrafanaUserHeader, tt.user)
+		}
+		if tt.ctxUser != "" {
+			req = req.WithContext(simplejson.ContextWithUser(req.Context(), tt.ctxUser))
+		}
+		w := httptest.NewRecorder()
+
+		gsj.ServeHTTP(w, req)
+		if w.Body.String() != tt.expect {
+			t.Fatalf("\nexpected: %q\ngot:%s", tt.expect, w.Body.String())
+		}
+	}
+}
+
+func TestDeterministicResponses(t *testing.T) {
+	labels := map[string]string{}
+	for _, k := range []string{"z", "y", "x", "c", "b", "a", "host", "env", "dc", "role"} {
+		labels[k] = k + "-value"
+	}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(hintedQuerier{}),
+		simplejson.WithTableQuerier(GSJExample{}),
+		simplejson.WithVariableResolver(hostVariableResolver{"eu": {"eu1"}, "us": {"us1"}}),
+	)
+	labeled := simplejson.New(
+		simplejson.WithQuerier(seriesQuerier{{Time: time.Unix(1, 0), Value: 1, Labels: labels}}),
+	)
+
+	tests := []struct {
+		h    *simplejson.Handler
+		path string
+		req  string
+	}{
+		{h: gsj, path: "/query", req: `{"targets": {"B": {"target": "upper_50"}, "A": {"target": "upper_75"}, "C": {"target": "t", "type": "table"}}}`},
+		{h: gsj, path: "/variable", req: `{"payload": {"target": "hosts", "variables": {"dc": ["us", "eu"]}}}`},
+		{h: labeled, path: "/query", req: `{"targets": [{"target": "a", "type": "labeled"}]}`},
+	}
+
+	for _, tt := range tests {
+		var first string
+		for i := 0; i < 20; i++ {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.req))
+			w := httptest.NewRecorder()
+			tt.h.ServeHTTP(w, req)
+
+			if i == 0 {
+				first = w.Body.String()
+				continue
+			}
+			if w.Body.String() != first {
+				t.Fatalf("%s: response changed between runs\nfirst: %s\ngot:%s", tt.path, first, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestSyntheticData(t *testing.T) {
+	args := &simplejson.QueryArguments{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(recordingQuerier{args: args}),
+		simplejson.WithSyntheticData(),
+	)
+
+	body := `{"range": {"from": "2016-10-31T06:00:00Z", "to": "2016-10-31T07:00:00Z"}, "interval": "15m",
+		"targets": [{"target": "__test__sine"}, {"target": "__test__random"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp []struct {
+		Target     string       `json:"target"`
+		DataPoints [][2]float64 `json:"datapoints"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(resp))
+	}
+	if !args.From.IsZero() {
+		t.Errorf("querier should not be called for synthetic targets")
+	}
+
+	from := float64(time.Date(2016, 10, 31, 6, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond))
+	for _, s := range resp {
+		if len(s.DataPoints) != 5 {
+			t.Fatalf("%s: expected 5 points, got %v", s.Target, s.DataPoints)
+		}
+		for i, dp := range s.DataPoints {
+			if want := from + float64(i)*15*60*1000; dp[1] != want {
+				t.Errorf("%s: point %d at %v, expected %v", s.Target, i, dp[1], want)
+			}
+		}
+	}
+	if sine := resp[0].DataPoints; math.Abs(sine[1][0]-1) > 1e-9 || math.Abs(sine[3][0]+1) > 1e-9 {
+		t.Errorf("unexpected sine values %v", sine)
+	}
+}
+
+func TestSyntheticDataMaxPoints(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithSyntheticData(),
+	)
+
+	tests := []struct {
+		body   string
+		expect int
+	}{
+		{body: `{"range": {"from": "2000-01-01T00:00:00Z", "to": "2020-01-01T00:00:00Z"}, "interval": "1ms", "targets": [{"target": "__test__sine"}]}`, expect: 10000},
+		{body: `{"range": {"from": "2000-01-01T00:00:00Z", "to": "2020-01-01T00:00:00Z"}, "interval": "1ms", "maxDataPoints": 500, "targets": [{"target": "__test__sine"}]}`, expect: 500},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(tt.body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp []struct {
+			DataPoints [][2]float64 `json:"datapoints"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp) != 1 || len(resp[0].DataPoints) > tt.expect {
+			t.Fatalf("expected at most %d points, got %d", tt.expect, len(resp[0].DataPoints))
+		}
+	}
+}
+
+type unfilteredAnnotator []simplejson.Annotation
+
+func (a unfilteredAnnotator) GrafanaAnnotations(ctx context.Context, query string, args simplejson.AnnotationsArguments) ([]simplejson.Annotation, error) {
+	return a, nil
+}
+
+func TestServerSideAnnotationTagFilter(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithAnnotator(unfilteredAnnotator{
+			{Time: time.Unix(100, 0), Title: "deploy web", Tags: []string{"deploy", "web"}},
+			{Time: time.Unix(200, 0), Title: "deploy db", Tags: []string{"deploy", "db"}},
+			{Time: time.Unix(300, 0), Title: "outage", Tags: []string{"web"}},
+		}),
+		simplejson.WithServerSideAnnotationTagFilter(),
+	)
+
+	tests := []struct {
+		query  string
+		expect []string
+	}{
+		{query: "", expect: []string{"deploy web", "deploy db", "outage"}},
+		{query: "#web", expect: []string{"deploy web", "outage"}},
+		{query: "deploy,web", expect: []string{"deploy web"}},
+		{query: "missing", expect: nil},
+	}
+
+	for _, tt := range tests {
+		reqBuf := bytes.NewBufferString(fmt.Sprintf(`{"annotation": {"name": "tags", "query": %q}}`, tt.query))
+		req := httptest.NewRequest(http.MethodPost, "/annotations", reqBuf)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, req)
+
+		var resp []struct {
+			Title string `json:"title"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("query %q: %v, %s", tt.query, err, w.Body.String())
+		}
+		var titles []string
+		for _, a := range resp {
+			titles = append(titles, a.Title)
+		}
+		if !reflect.DeepEqual(titles, tt.expect) {
+			t.Errorf("query %q\nexpected: %v\ngot:%v", tt.query, tt.expect, titles)
+		}
+	}
+}
+
+func TestWithResponseEnvelope(t *testing.T) {
+	tests := []struct {
+		opts   []simplejson.Opt
+		path   string
+		req    string
+		expect string
+	}{
+		{
+			opts:   []simplejson.Opt{simplejson.WithSearcher(GSJExample{})},
+			path:   "/search",
+			req:    `{"target": "upper_50"}`,
+			expect: `{"data":["example1","example2","example3"]}`,
+		},
+		{
+			opts:   []simplejson.Opt{simplejson.WithQuerier(seriesQuerier{{Time: time.Unix(1, 0), Value: 1}})},
+			path:   "/query",
+			req:    `{"targets": [{"target": "a"}]}`,
+			expect: `{"data":[{"target":"a","datapoints":[[1,1000]]}]}`,
+		},
+		{
+			opts: []simplejson.Opt{
+				simplejson.WithQuerier(seriesQuerier{{Time: time.Unix(1, 0), Value: 1}}),
+				simplejson.WithStreamingQueries(),
+			},
+			path:   "/query",
+			req:    `{"targets": [{"target": "a"}, {"target": "b"}]}`,
+			expect: `{"data":[{"target":"a","datapoints":[[1,1000]]},{"target":"b","datapoints":[[1,1000]]}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		gsj := simplejson.New(append(tt.opts, simplejson.WithResponseEnvelope("data"))...)
+		req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.req))
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, req)
+
+		if w.Body.String() != tt.expect {
+			t.Errorf("%s\nexpected: %s\ngot:%s", tt.path, tt.expect, w.Body.String())
+		}
+	}
+}
+
+type countingSearcher int
+
+func (n countingSearcher) GrafanaSearchStream(ctx context.Context, target string, emit func(string) error) error {
+	for i := 0; i < int(n); i++ {
+		if err := emit(fmt.Sprintf("%s%d", target, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestWithStreamingSearcher(t *testing.T) {
+	const n = 100000
+	gsj := simplejson.New(
+		simplejson.WithStreamingSearcher(countingSearcher(n)),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(`{"target": "metric"}`))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var resp []string
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != n {
+		t.Fatalf("expected %d results, got %d", n, len(resp))
+	}
+	if resp[0] != "metric0" || resp[n-1] != fmt.Sprintf("metric%d", n-1) {
+		t.Errorf("unexpected results %q ... %q", resp[0], resp[n-1])
+	}
+
+	empty := simplejson.New(simplejson.WithStreamingSearcher(countingSearcher(0)))
+	w = httptest.NewRecorder()
+	empty.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(`{"target": "metric"}`)))
+	if w.Body.String() != "[]" {
+		t.Errorf("expected empty array, got %s", w.Body.String())
+	}
+}
+
+func TestQueryTimezone(t *testing.T) {
+	now := time.Date(2016, 10, 31, 23, 30, 0, 0, time.UTC)
+	args := &simplejson.QueryArguments{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(recordingQuerier{args: args}),
+		simplejson.WithNowFunc(func() time.Time { return now }),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"rangeRaw": {"from": "now/d", "to": "now"}, "timezone": "Asia/Tokyo", "targets": [{"target": "a"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if args.Location == nil || args.Location.String() != "Asia/Tokyo" {
+		t.Fatalf("expected Asia/Tokyo location, got %v", args.Location)
+	}
+	if expect := time.Date(2016, 10, 31, 15, 0, 0, 0, time.UTC); !args.From.Equal(expect) {
+		t.Errorf("expected start of the user's day %v, got %v", expect, args.From)
+	}
+
+	reqBuf = bytes.NewBufferString(`{"timezone": "Not/AZone", "targets": [{"target": "a"}]}`)
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown timezone, got %d", w.Code)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	var points []simplejson.DataPoint
+	for _, s := range []int64{0, 1, 2, 3, 10, 11, 19} {
+		points = append(points, simplejson.DataPoint{Time: time.Unix(s, 0), Value: float64(s)})
+	}
+
+	tests := []struct {
+		maxDPs int
+		agg    simplejson.Aggregation
+		expect []float64
+	}{
+		{maxDPs: 0, agg: simplejson.AggregateSum, expect: []float64{0, 1, 2, 3, 10, 11, 19}},
+		{maxDPs: 10, agg: simplejson.AggregateSum, expect: []float64{0, 1, 2, 3, 10, 11, 19}},
+		{maxDPs: 2, agg: simplejson.AggregateSum, expect: []float64{6, 40}},
+		{maxDPs: 2, agg: simplejson.AggregateLast, expect: []float64{3, 19}},
+		{maxDPs: 4, agg: simplejson.AggregateMax, expect: []float64{3, 11, 19}},
+		{maxDPs: 4, agg: simplejson.AggregateAvg, expect: []float64{1.5, 10.5, 19}},
+	}
+
+	for _, tt := range tests {
+		var got []float64
+		for _, dp := range simplejson.Downsample(points, tt.maxDPs, tt.agg) {
+			got = append(got, dp.Value)
+		}
+		if !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("maxDPs %d\nexpected: %v\ngot:%v", tt.maxDPs, tt.expect, got)
+		}
+	}
+}
+
+func TestWithHealthCheck(t *testing.T) {
+	var healthErr error
+	gsj := simplejson.New(
+		simplejson.WithHealthCheck(func(ctx context.Context) error {
+			if ctx == nil {
+				return errors.New("no context")
+			}
+			return healthErr
+		}),
+	)
+
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Fatalf("expected 200 OK, got %d %q", w.Code, w.Body.String())
+	}
+
+	healthErr = errors.New("database unavailable")
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "database unavailable") {
+		t.Errorf("expected the error text in the body, got %q", w.Body.String())
+	}
+}
+
+func TestWithNotFoundHandler(t *testing.T) {
+	plain := simplejson.New()
+	w := httptest.NewRecorder()
+	plain.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "OK") {
+		t.Fatalf("expected a plain 404, got %d %q", w.Code, w.Body.String())
+	}
+
+	gsj := simplejson.New(
+		simplejson.WithNotFoundHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"error":"no such path %s"}`, r.URL.Path)
+		})),
+	)
+
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if expect := `{"error":"no such path /missing"}`; w.Code != http.StatusNotFound || w.Body.String() != expect {
+		t.Fatalf("expected custom 404 %s, got %d %s", expect, w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Errorf("expected 200 OK for /, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+type hostsQuerier []string
+
+func (q hostsQuerier) GrafanaMultiQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.Series, error) {
+	var out []simplejson.Series
+	for i, h := range q {
+		out = append(out, simplejson.Series{
+			Target: target + "{host=" + h + "}",
+			DataPoints: []simplejson.DataPoint{
+				{Time: time.Unix(2, 0), Value: float64(i + 1)},
+				{Time: time.Unix(1, 0), Value: float64(i)},
+			},
+		})
+	}
+	return out, nil
+}
+
+func TestWithMultiQuerier(t *testing.T) {
+	expect := `[{"target":"cpu{host=a}","datapoints":[[0,1000],[1,2000]]},{"target":"cpu{host=b}","datapoints":[[1,1000],[2,2000]]},{"target":"mem{host=a}","datapoints":[[0,1000],[1,2000]]},{"target":"mem{host=b}","datapoints":[[1,1000],[2,2000]]}]`
+
+	for _, stream := range []bool{false, true} {
+		opts := []simplejson.Opt{simplejson.WithMultiQuerier(hostsQuerier{"a", "b"})}
+		if stream {
+			opts = append(opts, simplejson.WithStreamingQueries())
+		}
+		gsj := simplejson.New(opts...)
+
+		reqBuf := bytes.NewBufferString(`{"targets": [{"target": "cpu"}, {"target": "mem"}]}`)
+		req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, req)
+
+		if w.Body.String() != expect {
+			t.Errorf("streaming %v\nexpected: %s\ngot:%s", stream, expect, w.Body.String())
+		}
+	}
+}
+
+type latencyBandQuerier struct{}
+
+func (latencyBandQuerier) GrafanaBandQuery(ctx context.Context, target string, args simplejson.QueryArguments) (simplejson.BandSeries, error) {
+	return simplejson.BandSeries{
+		{Time: time.Unix(2, 0), Value: 5, Lower: 4, Upper: math.NaN()},
+		{Time: time.Unix(1, 0), Value: 2, Lower: 1, Upper: 3},
+	}, nil
+}
+
+func TestWithBandQuerier(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithBandQuerier(latencyBandQuerier{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "latency", "type": "band"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	expect := `[{"target":"latency","type":"band","datapoints":[{"time":1000,"value":2,"lower":1,"upper":3},{"time":2000,"value":5,"lower":4,"upper":null}]}]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %s\ngot:%s", expect, w.Body.String())
+	}
+
+	noBand := simplejson.New(simplejson.WithQuerier(GSJExample{}))
+	w = httptest.NewRecorder()
+	noBand.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"targets": [{"target": "latency", "type": "band"}]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a BandQuerier, got %d", w.Code)
+	}
+}
+
+func TestNullDataPoints(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(seriesQuerier{
+			{Time: time.Unix(1, 0), Value: 1},
+			simplejson.NullDataPoint(time.Unix(2, 0)),
+			{Time: time.Unix(3, 0), Value: 0},
+		}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "a"}, {"target": "b", "type": "labeled"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	expect := `[{"target":"a","datapoints":[[1,1000],[null,2000],[0,3000]]},{"target":"b","datapoints":[{"value":1,"time":1000},{"value":null,"time":2000},{"value":0,"time":3000}]}]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %s\ngot:%s", expect, w.Body.String())
+	}
+
+	sparse := simplejson.SparseSeries([]simplejson.DataPoint{simplejson.NullDataPoint(time.Unix(1, 0)), {Time: time.Unix(2, 0), Value: 0}})
+	if len(sparse) != 1 || sparse[0].Null {
+		t.Errorf("expected null points to be dropped, got %v", sparse)
+	}
+}
+
+var errPrimaryDown = errors.New("primary down")
+
+type failingQuerier struct {
+	err   error
+	calls *int
+}
+
+func (q failingQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	*q.calls++
+	return nil, q.err
+}
+
+func TestFallbackQuerier(t *testing.T) {
+	fallback := seriesQuerier{{Time: time.Unix(1, 0), Value: 7}}
+	isDown := func(err error) bool { return errors.Is(err, errPrimaryDown) }
+
+	tests := []struct {
+		name   string
+		err    error
+		cancel bool
+		expect []simplejson.DataPoint
+		fail   bool
+	}{
+		{name: "fallback", err: errPrimaryDown, expect: fallback},
+		{name: "other error", err: errors.New("bad target"), fail: true},
+		{name: "cancelled", err: errPrimaryDown, cancel: true, fail: true},
+	}
+
+	for _, tt := range tests {
+		calls := 0
+		q := simplejson.FallbackQuerier(failingQuerier{err: tt.err, calls: &calls}, fallback, isDown)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.cancel {
+			cancel()
+		}
+		got, err := q.GrafanaQuery(ctx, "a", simplejson.QueryArguments{})
+		cancel()
+
+		if calls != 1 {
+			t.Errorf("%s: expected primary to be called once, got %d", tt.name, calls)
+		}
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error, %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("%s\nexpected: %v\ngot:%v", tt.name, tt.expect, got)
+		}
+	}
+}
+
+type salesForecaster struct{}
+
+func (salesForecaster) GrafanaForecastQuery(ctx context.Context, target string, args simplejson.QueryArguments) (simplejson.ForecastSeries, error) {
+	return simplejson.ForecastSeries{
+		Confidence: 0.95,
+		Points: []simplejson.ForecastPoint{
+			{Time: time.Unix(2, 0), Estimate: 12, Lower: 9, Upper: 15},
+			{Time: time.Unix(1, 0), Estimate: 10, Lower: 8, Upper: 12},
+		},
+	}, nil
+}
+
+func TestWithForecastQuerier(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithForecastQuerier(salesForecaster{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "sales", "type": "forecast"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	expect := `[{"target":"sales","type":"forecast","confidence":0.95,"datapoints":[{"time":1000,"yhat":10,"yhat_lower":8,"yhat_upper":12},{"time":2000,"yhat":12,"yhat_lower":9,"yhat_upper":15}]}]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %s\ngot:%s", expect, w.Body.String())
+	}
+}
+
+func TestWithCORS(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithCORS("https://tool.example.com"),
+	)
+
+	req := httptest.NewRequest(http.MethodOptions, "/query", nil)
+	req.Header.Set("Origin", "https://tool.example.com")
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 for preflight, got %d", w.Code)
+	}
+	for _, h := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Methods", "Access-Control-Allow-Headers"} {
+		if w.Header().Get(h) == "" {
+			t.Errorf("expected %s to be set", h)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"targets": [{"target": "upper_50"}]}`))
+	req.Header.Set("Origin", "https://tool.example.com")
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://tool.example.com" {
+		t.Errorf("expected CORS headers on query, got %d %v", w.Code, w.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodOptions, "/query", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("unexpected CORS headers for disallowed origin")
+	}
+
+	plain := simplejson.New(simplejson.WithQuerier(GSJExample{}), simplejson.WithCORS())
+	req = httptest.NewRequest(http.MethodOptions, "/query", nil)
+	req.Header.Set("Origin", "https://tool.example.com")
+	w = httptest.NewRecorder()
+	plain.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("unexpected CORS headers with no origins configured")
+	}
+}
+
+func TestTrailingSlashRoutes(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithSearcher(GSJExample{}),
+	)
+
+	tests := []struct {
+		path   string
+		req    string
+		code   int
+		expect string
+	}{
+		{path: "/query/", req: `{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "upper_50"}]}`, code: http.StatusOK, expect: `[{"target":"upper_50","datapoints":[[1234,1477917219866],[1500,1477917224866]]}]`},
+		{path: "/search/", req: `{"target": "upper_50"}`, code: http.StatusOK, expect: `["example1","example2","example3"]`},
+		{path: "/missing/", code: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.req))
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Fatalf("%s: expected %d, got %d: %s", tt.path, tt.code, w.Code, w.Body.String())
+		}
+		if tt.expect != "" && w.Body.String() != tt.expect {
+			t.Errorf("%s\nexpected: %s\ngot:%s", tt.path, tt.expect, w.Body.String())
+		}
+	}
+}
+
+type hostPayloadOptioner map[string][]string
+
+func (o hostPayloadOptioner) GrafanaMetricPayloadOptions(ctx context.Context, args simplejson.MetricPayloadOptionsArguments) ([]simplejson.MetricPayloadOption, error) {
+	if args.Metric != "cpu" || args.Name != "host" {
+		return nil, fmt.Errorf("unknown field %s of %s", args.Name, args.Metric)
+	}
+	var payload struct {
+		DC string `json:"dc"`
+	}
+	if err := json.Unmarshal(args.Payload, &payload); err != nil {
+		return nil, err
+	}
+
+	var out []simplejson.MetricPayloadOption
+	for _, h := range o[payload.DC] {
+		out = append(out, simplejson.MetricPayloadOption{Label: strings.ToUpper(h), Value: h})
+	}
+	return out, nil
+}
+
+func TestHandleMetricPayloadOptions(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithMetricPayloadOptioner(hostPayloadOptioner{"eu": {"web1", "web2"}}),
+	)
+
+	tests := []struct {
+		req    string
+		code   int
+		expect string
+	}{
+		{req: `{"metric": "cpu", "name": "host", "payload": {"dc": "eu"}}`, code: http.StatusOK, expect: `[{"label":"WEB1","value":"web1"},{"label":"WEB2","value":"web2"}]`},
+		{req: `{"metric": "cpu", "name": "host", "payload": {"dc": "us"}}`, code: http.StatusOK, expect: `[]`},
+		{req: `{"metric": "mem", "name": "host", "payload": {}}`, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/metric-payload-options", bytes.NewBufferString(tt.req))
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Fatalf("%s: expected %d, got %d", tt.req, tt.code, w.Code)
+		}
+		if tt.expect != "" && w.Body.String() != tt.expect {
+			t.Errorf("%s\nexpected: %s\ngot:%s", tt.req, tt.expect, w.Body.String())
+		}
+	}
+}
+
+type boolTableQuerier struct{}
+
+func (boolTableQuerier) GrafanaQueryTable(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, error) {
+	return []simplejson.TableColumn{
+		{Text: "Time", Data: simplejson.TableTimeColumn{time.Unix(1, 0).UTC(), time.Unix(2, 0).UTC()}},
+		{Text: "Host", Data: simplejson.TableStringColumn{"web1", "web2"}},
+		{Text: "Up", Data: simplejson.TableBoolColumn{true, false}},
+		{Text: "Load", Data: simplejson.TableNumberColumn{0.5, 0}},
+	}, nil
+}
+
+func TestTableBoolColumn(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTableQuerier(boolTableQuerier{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "hosts", "type": "table"}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	expect := `[{"type":"table","columns":[{"text":"Time","type":"time"},{"text":"Host","type":"string"},{"text":"Up","type":"bool"},{"text":"Load","type":"number"}],"rows":[["1970-01-01T00:00:01Z","web1",true,0.5],["1970-01-01T00:00:02Z","web2",false,0]]}]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %s\ngot:%s", expect, w.Body.String())
+	}
+}
+
+type panickingQuerier struct{}
+
+func (panickingQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	var m map[string]int
+	m[target]++
+	return nil, nil
+}
+
+func TestWithRecovery(t *testing.T) {
+	var recovered interface{}
+	logs := &bytes.Buffer{}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(panickingQuerier{}),
+		simplejson.WithLogger(log.New(logs, "", 0)),
+		simplejson.WithRecovery(func(r *http.Request, v interface{}) {
+			recovered = v
+		}),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"targets": [{"target": "a"}]}`))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "nil map") {
+		t.Errorf("panic details should not be sent to the client, got %q", w.Body.String())
+	}
+	if recovered == nil {
+		t.Errorf("expected the panic value to be passed to the hook")
+	}
+	if !strings.Contains(logs.String(), "panic serving /query") {
+		t.Errorf("expected the panic to be logged, got %q", logs.String())
+	}
+}
+
+func TestAnnotationsNDJSON(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithAnnotator(fieldsAnnotator{}),
+	)
+
+	reqBody := `{"annotation": {"name": "query", "query": "q", "enable": true}}`
+
+	req := httptest.NewRequest(http.MethodPost, "/annotations", bytes.NewBufferString(reqBody))
+	req.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	if ct := w.Header().Get("Content-Type"); ct != simplejson.NDJSONContentType {
+		t.Fatalf("expected content type %s, got %s", simplejson.NDJSONContentType, ct)
+	}
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", w.Body.String())
+	}
+	for _, l := range lines {
+		var ann map[string]interface{}
+		if err := json.Unmarshal([]byte(l), &ann); err != nil {
+			t.Fatalf("line %q is not a JSON object, %v", l, err)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/annotations", bytes.NewBufferString(reqBody))
+	req.Header.Set("Accept", "application/json, text/plain, */*")
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if !strings.HasPrefix(w.Body.String(), "[") {
+		t.Errorf("expected a JSON array for the stock plugin, got %q", w.Body.String())
+	}
+}
+
+func TestWithAccessLog(t *testing.T) {
+	body := `{"target": "upper_50"}`
+	expectBytes := len(`["example1","example2","example3"]`)
+
+	common := &bytes.Buffer{}
+	gsj := simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithAccessLog(common, simplejson.AccessLogCommon),
+	)
+	req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(body))
+	gsj.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := common.String()
+	for _, want := range []string{"192.0.2.1 - - [", `"POST /search HTTP/1.1" 200 ` + fmt.Sprint(expectBytes) + " "} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %q in common log line %q", want, line)
+		}
+	}
+
+	jsonLog := &bytes.Buffer{}
+	gsj = simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithAccessLog(jsonLog, simplejson.AccessLogJSON),
+	)
+	gsj.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/missing", nil))
+
+	var entry struct {
+		Method     string   `json:"method"`
+		Path       string   `json:"path"`
+		Status     int      `json:"status"`
+		Bytes      int      `json:"bytes"`
+		DurationMS *float64 `json:"duration_ms"`
+	}
+	if err := json.Unmarshal(jsonLog.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid JSON log line %q, %v", jsonLog.String(), err)
+	}
+	if entry.Method != http.MethodPost || entry.Path != "/missing" || entry.Status != http.StatusNotFound || entry.Bytes == 0 || entry.DurationMS == nil {
+		t.Errorf("unexpected log entry %+v", entry)
+	}
+}
+
+type errQuerier struct {
+	err error
+}
+
+func (q errQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	return nil, q.err
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   int
+		expect string
+	}{
+		{
+			err:    &simplejson.Error{Status: http.StatusNotFound, Message: "no such metric", Err: errors.New("select failed: table metrics_x missing")},
+			code:   http.StatusNotFound,
+			expect: "no such metric\n",
+		},
+		{
+			err:    fmt.Errorf("wrapped: %w", &simplejson.Error{Err: errors.New("connection refused to 10.0.0.1")}),
+			code:   http.StatusInternalServerError,
+			expect: "Internal Server Error\n",
+		},
+		{
+			err:    errors.New("plain"),
+			code:   http.StatusInternalServerError,
+			expect: "plain\n",
+		},
+	}
+
+	for _, tt := range tests {
+		gsj := simplejson.New(
+			simplejson.WithQuerier(errQuerier{tt.err}),
+			simplejson.WithErrorLog(1),
+		)
+
+		req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"targets": [{"target": "a"}]}`))
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, req)
+
+		if w.Code != tt.code || w.Body.String() != tt.expect {
+			t.Errorf("%v: expected %d %q, got %d %q", tt.err, tt.code, tt.expect, w.Code, w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/errors", nil))
+		if !strings.Contains(w.Body.String(), tt.err.Error()) {
+			t.Errorf("expected the full error %q to be recorded, got %s", tt.err, w.Body.String())
+		}
+	}
+}
+
+type pagedTableQuerier []string
+
+func (q pagedTableQuerier) GrafanaQueryTable(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, error) {
+	return nil, errors.New("expected a paged query")
+}
+
+func (q pagedTableQuerier) GrafanaQueryTablePage(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, string, error) {
+	const pageSize = 2
+	start := 0
+	if args.Cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(args.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	end := start + pageSize
+	next := strconv.Itoa(end)
+	if end >= len(q) {
+		end = len(q)
+		next = ""
+	}
+	return []simplejson.TableColumn{{Text: "Name", Data: simplejson.TableStringColumn(q[start:end])}}, next, nil
+}
+
+func TestPagedTableQuerier(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTableQuerier(pagedTableQuerier{"a", "b", "c", "d", "e"}),
+	)
+
+	type page struct {
+		Rows [][]string `json:"rows"`
+		Meta *struct {
+			NextCursor string `json:"nextCursor"`
+		} `json:"meta"`
+	}
+
+	var names []string
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		body := fmt.Sprintf(`{"targets": [{"target": "names", "type": "table", "data": {"cursor": %q}}]}`, cursor)
+		req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, req)
+
+		var resp []page
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%v, %s", err, w.Body.String())
+		}
+		for _, r := range resp[0].Rows {
+			names = append(names, r[0])
+		}
+		if resp[0].Meta == nil {
+			break
+		}
+		cursor = resp[0].Meta.NextCursor
+	}
+
+	if expect := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(names, expect) {
+		t.Fatalf("expected %v, got %v", expect, names)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/query?cursor=4", bytes.NewBufferString(`{"targets": [{"target": "names", "type": "table"}]}`))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if expect := `[{"type":"table","columns":[{"text":"Name","type":"string"}],"rows":[["e"]]}]`; w.Body.String() != expect {
+		t.Errorf("cursor query parameter\nexpected: %s\ngot:%s", expect, w.Body.String())
+	}
+}
+
+func TestWithAnnotationTagsAsString(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithAnnotator(unfilteredAnnotator{
+			{Time: time.Unix(1, 0), Title: "deploy", Tags: []string{"deploy", "web"}},
+			{Time: time.Unix(2, 0), Title: "untagged"},
+		}),
+		simplejson.WithAnnotationTagsAsString(","),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/annotations", bytes.NewBufferString(`{"annotation": {"name": "a"}}`))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	var resp []struct {
+		Tags interface{} `json:"tags"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 2 || resp[0].Tags != "deploy,web" || resp[1].Tags != "" {
+		t.Fatalf("expected joined tags, got %s", w.Body.String())
+	}
+}
+
+type argsByTargetQuerier map[string]simplejson.QueryArguments
+
+func (q argsByTargetQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	q[target] = args
+	return nil, nil
+}
+
+func TestHiddenTargetsSkipped(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(seriesQuerier{{Time: time.Unix(1, 0), Value: 1}}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "shown", "refId": "A"}, {"target": "hidden", "refId": "B", "hide": true}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	var resp []struct {
+		Target string `json:"target"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || resp[0].Target != "shown" {
+		t.Fatalf("expected only the visible series, got %s", w.Body.String())
+	}
+}
+
+func TestRefIDAndHide(t *testing.T) {
+	body := `{"targets": [{"target": "a", "refId": "A"}, {"target": "b", "refId": "B", "hide": true}]}`
+
+	got := argsByTargetQuerier{}
+	gsj := simplejson.New(simplejson.WithQuerier(got), simplejson.WithIncludeHidden())
+	gsj.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(body)))
+
+	if a := got["a"]; a.RefID != "A" || a.Hide {
+		t.Errorf("unexpected arguments for a, %+v", a)
+	}
+	if b := got["b"]; b.RefID != "B" || !b.Hide {
+		t.Errorf("unexpected arguments for b, %+v", b)
+	}
+
+	got = argsByTargetQuerier{}
+	gsj = simplejson.New(simplejson.WithQuerier(got))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(body)))
+
+	if _, ok := got["b"]; ok {
+		t.Errorf("hidden target should not be queried")
+	}
+	if expect := `[{"target":"a","datapoints":[]}]`; w.Body.String() != expect {
+		t.Errorf("\nexpected: %s\ngot:%s", expect, w.Body.String())
+	}
+}
+
+func TestWithOutputLocation(t *testing.T) {
+	naive := time.Date(2016, 10, 31, 12, 0, 0, 0, time.UTC)
+	gsj := simplejson.New(
+		simplejson.WithQuerier(seriesQuerier{{Time: naive, Value: 1}}),
+		simplejson.WithOutputLocation(time.FixedZone("UTC+2", 2*60*60)),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"targets": [{"target": "a"}]}`))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	want := time.Date(2016, 10, 31, 10, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	if expect := fmt.Sprintf(`[{"target":"a","datapoints":[[1,%d]]}]`, want); w.Body.String() != expect {
+		t.Fatalf("\nexpected: %s\ngot:%s", expect, w.Body.String())
+	}
+}
+
+func TestWithWarmup(t *testing.T) {
+	calls := 0
+	gsj, err := simplejson.NewWithError(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithWarmup(func(ctx context.Context) error {
+			calls++
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected warmup to run at construction, ran %d times", calls)
+	}
+	if err := gsj.Warmup(context.Background()); err != nil || calls != 2 {
+		t.Fatalf("expected explicit warmup to run, err: %v, calls: %d", err, calls)
+	}
+
+	_, err = simplejson.NewWithError(
+		simplejson.WithWarmup(func(ctx context.Context) error {
+			return errors.New("connection refused")
+		}),
+	)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expected warmup error, got %v", err)
+	}
+}
+
+func TestWithGzip(t *testing.T) {
+	body := `{"target": "upper_50"}`
+	expect := `["example1","example2","example3"]`
+
+	gsj := simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithGzip(10),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(body))
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("expected gzip content encoding, got %q", ce)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("invalid gzip response, %v", err)
+	}
+	bs, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("invalid gzip response, %v", err)
+	}
+	if string(bs) != expect {
+		t.Fatalf("expected %s, got %s", expect, bs)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(body))
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if ce := w.Header().Get("Content-Encoding"); ce != "" || w.Body.String() != expect {
+		t.Fatalf("expected plain response without Accept-Encoding, got %q, %s", ce, w.Body.String())
+	}
+
+	gsj = simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithGzip(1024),
+	)
+	req = httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(body))
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+	if ce := w.Header().Get("Content-Encoding"); ce != "" || w.Body.String() != expect {
+		t.Fatalf("expected plain response below threshold, got %q, %s", ce, w.Body.String())
+	}
+}
+
+type rowTableQuerier struct{}
+
+func (rowTableQuerier) GrafanaQueryTable(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, error) {
+	return nil, errors.New("unexpected call to GrafanaQueryTable")
+}
+
+func (rowTableQuerier) GrafanaQueryTableRows(ctx context.Context, target string, args simplejson.TableQueryArguments, w *simplejson.TableRowWriter) error {
+	if target == "missing" {
+		return errors.New("no such table")
+	}
+	if err := w.Columns(
+		simplejson.TableColumn{Text: "Time", Data: simplejson.TableTimeColumn(nil)},
+		simplejson.TableColumn{Text: "Value", Data: simplejson.TableNumberColumn(nil)},
+	); err != nil {
+		return err
+	}
+	for i := 0; i < 1000; i++ {
+		if err := w.WriteRow(args.From.Add(time.Duration(i)*time.Second), float64(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRowTableQuerier(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithTableQuerier(rowTableQuerier{}),
+	)
+
+	q := `{
+  "range": { "from": "2016-04-15T13:44:39.070Z", "to": "2016-04-15T14:44:39.070Z" },
+  "targets": [
+     { "target": "upper_50", "refId": "A", "type": "timeserie" },
+     { "target": "big", "refId": "B", "type": "table" }
+  ]
+}`
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(q)))
+
+	var resp []struct {
+		Target  string `json:"target"`
+		Type    string `json:"type"`
+		Columns []struct {
+			Text string `json:"text"`
+			Type string `json:"type"`
+		} `json:"columns"`
+		Rows [][]interface{} `json:"rows"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %s, %v", w.Body.String(), err)
+	}
+	if len(resp) != 2 || resp[0].Target != "upper_50" || resp[1].Type != "table" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if len(resp[1].Columns) != 2 || resp[1].Columns[0].Type != "time" || resp[1].Columns[1].Type != "number" {
+		t.Fatalf("unexpected columns %+v", resp[1].Columns)
+	}
+	if len(resp[1].Rows) != 1000 || resp[1].Rows[999][1] != 999.0 || resp[1].Rows[0][0] != "2016-04-15T13:44:39.07Z" {
+		t.Fatalf("unexpected rows, got %d, first %v", len(resp[1].Rows), resp[1].Rows[0])
+	}
+
+	q = `{
+  "range": { "from": "2016-04-15T13:44:39.070Z", "to": "2016-04-15T14:44:39.070Z" },
+  "targets": [ { "target": "missing", "refId": "A", "type": "table" } ]
+}`
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(q)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected error before rows are written to be reported, got %d, %s", w.Code, w.Body.String())
+	}
+}
+
+// bodyCapture is middleware that records the response body as written by
+// the handlers it wraps.
+type bodyCapture struct {
+	bytes.Buffer
+}
+
+type bodyCaptureWriter struct {
+	http.ResponseWriter
+	buf *bytes.Buffer
+}
+
+func (w bodyCaptureWriter) Write(bs []byte) (int, error) {
+	w.buf.Write(bs)
+	return w.ResponseWriter.Write(bs)
+}
+
+func (c *bodyCapture) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(bodyCaptureWriter{ResponseWriter: w, buf: &c.Buffer}, r)
+	})
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	body := `{"target": "upper_50"}`
+	search := func(gsj *simplejson.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(body))
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, req)
+		return w
+	}
+
+	outer := &bodyCapture{}
+	w := search(simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithMiddleware(outer.middleware, simplejson.GzipMiddleware(0)),
+	))
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip response")
+	}
+	if !bytes.HasPrefix(outer.Bytes(), []byte{0x1f, 0x8b}) {
+		t.Fatalf("expected outer middleware to see compressed body, got %q", outer.String())
+	}
+
+	inner := &bodyCapture{}
+	w = search(simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithMiddleware(simplejson.GzipMiddleware(0), inner.middleware),
+	))
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip response")
+	}
+	if expect := `["example1","example2","example3"]`; inner.String() != expect {
+		t.Fatalf("expected inner middleware to see %s, got %q", expect, inner.String())
+	}
+}
+
+func TestWithBatchRequests(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithBatchRequests(),
+	)
+
+	q := `[
+		{
+			"range": { "from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z" },
+			"targets": [ { "target": "upper_50", "refId": "A" } ]
+		},
+		{
+			"range": { "from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z" },
+			"targets": [ { "target": "upper_75", "refId": "A" } ]
+		}
+	]`
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(q)))
+
+	expect := `[[{"target":"upper_50","datapoints":[[1234,1477917219866],[1500,1477917224866]]}],[{"target":"upper_75","datapoints":[[1234,1477917219866],[1500,1477917224866]]}]]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %s\ngot: %s", expect, w.Body.String())
+	}
+
+	q = `{
+		"range": { "from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z" },
+		"targets": [ { "target": "upper_50", "refId": "A" } ]
+	}`
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(q)))
+
+	expect = `[{"target":"upper_50","datapoints":[[1234,1477917219866],[1500,1477917224866]]}]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %s\ngot: %s", expect, w.Body.String())
+	}
+}
+
+// blockingQuerier blocks until the query context is done.
+type blockingQuerier struct{}
+
+func (blockingQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestWithQueryTimeout(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(blockingQuerier{}),
+		simplejson.WithQueryTimeout(10*time.Millisecond),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "stuck"}]}`)
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected query to return once the timeout passed, took %v", d)
+	}
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status %d, got %d, %s", http.StatusGatewayTimeout, w.Code, w.Body.String())
+	}
+}
+
+type freshnessQuerier struct {
+	GSJExample
+}
+
+func (freshnessQuerier) GrafanaSeriesHints(ctx context.Context, target string) (simplejson.SeriesHints, error) {
+	switch target {
+	case "upper_50":
+		return simplejson.SeriesHints{MaxAge: time.Hour}, nil
+	case "upper_75":
+		return simplejson.SeriesHints{MaxAge: 10 * time.Second}, nil
+	default:
+		return simplejson.SeriesHints{}, nil
+	}
+}
+
+func TestSeriesMaxAge(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(freshnessQuerier{}),
+	)
+
+	tests := []struct {
+		targets string
+		expect  string
+	}{
+		{targets: `[{"target": "upper_50"}, {"target": "upper_75"}]`, expect: "max-age=10"},
+		{targets: `[{"target": "upper_50"}]`, expect: "max-age=3600"},
+		{targets: `[{"target": "upper_50"}, {"target": "upper_90"}]`, expect: ""},
+	}
+	for _, tt := range tests {
+		reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": ` + tt.targets + `}`)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+		if cc := w.Header().Get("Cache-Control"); cc != tt.expect {
+			t.Errorf("targets %s, expected Cache-Control %q, got %q", tt.targets, tt.expect, cc)
+		}
+	}
+}
+
+// rangeLimitedQuerier refuses queries spanning more than a day.
+type rangeLimitedQuerier struct{}
+
+func (rangeLimitedQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	if args.To.Sub(args.From) > 24*time.Hour {
+		return nil, &simplejson.RangeTooLargeError{MaxRange: 24 * time.Hour}
+	}
+	return nil, nil
+}
+
+func TestRangeTooLargeError(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(rangeLimitedQuerier{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-01T00:00:00Z", "to": "2016-10-31T00:00:00Z"}, "targets": [{"target": "cpu"}]}`)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected JSON response, got %q", ct)
+	}
+	expect := `{"message":"query range too large, the maximum is 24h0m0s","maxRangeMs":86400000}`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %s\ngot: %s", expect, w.Body.String())
+	}
+}
+
+func TestWithMaxAdhocFilters(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithMaxAdhocFilters(2),
+	)
+
+	tests := []struct {
+		filters string
+		expect  int
+	}{
+		{filters: `[{"key": "a", "operator": "=", "value": "1"}, {"key": "b", "operator": "=", "value": "2"}]`, expect: http.StatusOK},
+		{filters: `[{"key": "a", "operator": "=", "value": "1"}, {"key": "b", "operator": "=", "value": "2"}, {"key": "c", "operator": "=", "value": "3"}]`, expect: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "upper_50"}], "adhocFilters": ` + tt.filters + `}`)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+		if w.Code != tt.expect {
+			t.Errorf("filters %s, expected status %d, got %d, %s", tt.filters, tt.expect, w.Code, w.Body.String())
+		}
+	}
+
+	if _, err := simplejson.NewWithError(simplejson.WithMaxAdhocFilters(-1)); err == nil {
+		t.Errorf("expected error for negative maximum")
+	}
+
+	// A maximum of 0 is unlimited.
+	gsj = simplejson.New(
+		simplejson.WithQuerier(GSJExample{}),
+		simplejson.WithMaxAdhocFilters(0),
+	)
+	reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "upper_50"}], "adhocFilters": ` + tests[1].filters + `}`)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected no limit with a maximum of 0, got status %d, %s", w.Code, w.Body.String())
+	}
+}
+
+func TestFileQuerier(t *testing.T) {
+	from := time.Date(2016, 10, 31, 6, 30, 0, 0, time.UTC)
+	to := time.Date(2016, 10, 31, 9, 0, 0, 0, time.UTC)
+	expect := map[string][]simplejson.DataPoint{
+		"cpu": {
+			{Time: time.Date(2016, 10, 31, 7, 0, 0, 0, time.UTC), Value: 2},
+			{Time: time.Date(2016, 10, 31, 8, 0, 0, 0, time.UTC), Value: 3},
+			simplejson.NullDataPoint(time.Date(2016, 10, 31, 9, 0, 0, 0, time.UTC)),
+		},
+		"mem": {
+			{Time: time.Date(2016, 10, 31, 8, 0, 0, 0, time.UTC), Value: 300},
+			{Time: time.Date(2016, 10, 31, 9, 0, 0, 0, time.UTC), Value: 400},
+		},
+	}
+
+	for _, path := range []string{"testdata/series.csv", "testdata/series.json"} {
+		fq, err := simplejson.NewFileQuerier(path)
+		if err != nil {
+			t.Fatalf("%s: unexpected error, %v", path, err)
+		}
+
+		for target, want := range expect {
+			got, err := fq.GrafanaQuery(context.Background(), target, simplejson.QueryArguments{
+				QueryCommonArguments: simplejson.QueryCommonArguments{From: from, To: to},
+			})
+			if err != nil {
+				t.Fatalf("%s: unexpected error querying %s, %v", path, target, err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("%s: %s expected %v, got %v", path, target, want, got)
+			}
+			for i := range want {
+				if !got[i].Time.Equal(want[i].Time) || got[i].Null != want[i].Null || (!want[i].Null && got[i].Value != want[i].Value) {
+					t.Fatalf("%s: %s expected %v, got %v", path, target, want, got)
+				}
+			}
+		}
+
+		targets, err := fq.GrafanaSearch(context.Background(), "")
+		if err != nil || !reflect.DeepEqual(targets, []string{"cpu", "mem"}) {
+			t.Fatalf("%s: expected targets cpu and mem, got %v, %v", path, targets, err)
+		}
+		if _, err := fq.GrafanaQuery(context.Background(), "disk", simplejson.QueryArguments{}); err == nil {
+			t.Fatalf("%s: expected error for unknown target", path)
+		}
+	}
+}
+
+// subMilliQuerier returns a point with sub-millisecond precision.
+type subMilliQuerier struct{}
+
+func (subMilliQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	return []simplejson.DataPoint{
+		{Time: time.Unix(1477917219, 866123456), Value: 1},
+	}, nil
+}
+
+func TestWithTimeResolution(t *testing.T) {
+	tests := []struct {
+		opts   []simplejson.Opt
+		expect string
+	}{
+		{expect: `[{"target":"a","datapoints":[[1,1477917219866]]},{"target":"b","datapoints":[{"value":1,"time":1477917219866}]}]`},
+		{opts: []simplejson.Opt{simplejson.WithTimeResolution(simplejson.TimeMicros)}, expect: `[{"target":"a","datapoints":[[1,1477917219866123]]},{"target":"b","datapoints":[{"value":1,"time":1477917219866123}]}]`},
+		{opts: []simplejson.Opt{simplejson.WithTimeResolution(simplejson.TimeNanos)}, expect: `[{"target":"a","datapoints":[[1,1477917219866123456]]},{"target":"b","datapoints":[{"value":1,"time":1477917219866123456}]}]`},
+		{opts: []simplejson.Opt{simplejson.WithTimeResolution(simplejson.TimeSeconds)}, expect: `[{"target":"a","datapoints":[[1,1477917219]]},{"target":"b","datapoints":[{"value":1,"time":1477917219}]}]`},
+	}
+	for _, tt := range tests {
+		gsj := simplejson.New(append(tt.opts, simplejson.WithQuerier(subMilliQuerier{}))...)
+
+		reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "a"}, {"target": "b", "type": "labeled"}]}`)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+		if w.Body.String() != tt.expect {
+			t.Errorf("\nexpected: %s\ngot: %s", tt.expect, w.Body.String())
+		}
+	}
+}
+
+func TestWithPathPrefix(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithPathPrefix("/grafana/"),
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/grafana/", gsj)
+	mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other"))
+	})
+
+	tests := []struct {
+		method, path string
+		status       int
+		expect       string
+	}{
+		{method: http.MethodGet, path: "/grafana/", status: http.StatusOK, expect: "OK"},
+		{method: http.MethodPost, path: "/grafana/search", status: http.StatusOK, expect: `["example1","example2","example3"]`},
+		{method: http.MethodPost, path: "/grafana/search/", status: http.StatusOK, expect: `["example1","example2","example3"]`},
+		{method: http.MethodGet, path: "/grafana/missing", status: http.StatusNotFound},
+		{method: http.MethodGet, path: "/other", status: http.StatusOK, expect: "other"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(`{"target": "a"}`))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Fatalf("%s: expected status %d, got %d", tt.path, tt.status, w.Code)
+		}
+		if tt.expect != "" && w.Body.String() != tt.expect {
+			t.Fatalf("%s: expected %q, got %q", tt.path, tt.expect, w.Body.String())
+		}
+	}
+}
+
+// talkersQuerier returns series whose last value depends on the target.
+type talkersQuerier struct{}
+
+func (talkersQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	last := map[string]float64{"low": 1, "mid": 50, "high": 100}
+	v, ok := last[target]
+	if !ok {
+		return nil, nil
+	}
+	return []simplejson.DataPoint{
+		{Time: args.To.Add(-time.Minute), Value: 1000 - v},
+		{Time: args.To, Value: v},
+	}, nil
+}
+
+func TestWithSortSeriesByLastValue(t *testing.T) {
+	tests := []struct {
+		desc   bool
+		expect []string
+	}{
+		{desc: true, expect: []string{"high", "mid", "low", "empty"}},
+		{desc: false, expect: []string{"empty", "low", "mid", "high"}},
+	}
+	for _, tt := range tests {
+		gsj := simplejson.New(
+			simplejson.WithQuerier(talkersQuerier{}),
+			simplejson.WithSortSeriesByLastValue(tt.desc),
+		)
+
+		reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "mid"}, {"target": "empty"}, {"target": "low"}, {"target": "high"}]}`)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+		var resp []struct {
+			Target string `json:"target"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response %s, %v", w.Body.String(), err)
+		}
+		var got []string
+		for _, r := range resp {
+			got = append(got, r.Target)
+		}
+		if !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("desc %v, expected %v, got %v", tt.desc, tt.expect, got)
+		}
+	}
+}
+
+func TestWithMetrics(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithMetrics(""),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(`{"target": "upper_50"}`))
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	expect := `["example1","example2","example3"]`
+	if w.Body.String() != expect {
+		t.Fatalf("\nexpected: %s\ngot: %s", expect, w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, simplejson.DefaultMetricsPath, nil)
+	w = httptest.NewRecorder()
+	gsj.ServeHTTP(w, req)
+
+	if want := `simplejson_requests_total{endpoint="/search",code="200"} 1`; !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("expected %q in telemetry, got:\n%s", want, w.Body.String())
+	}
+	if want := `simplejson_request_duration_seconds_count{endpoint="/search"} 1`; !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("expected %q in telemetry, got:\n%s", want, w.Body.String())
+	}
+
+	if _, err := simplejson.NewWithError(simplejson.WithMetrics("/query")); err == nil {
+		t.Fatalf("expected error for telemetry path clashing with /query")
+	}
+	if _, err := simplejson.NewWithError(simplejson.WithErrorLog(5), simplejson.WithMetrics("/debug/errors")); err == nil {
+		t.Fatalf("expected error for telemetry path clashing with /debug/errors")
+	}
+	if _, err := simplejson.NewWithError(simplejson.WithMetrics("/beta/metrics"), simplejson.WithProfile("beta", simplejson.WithQuerier(GSJExample{}))); err == nil {
+		t.Fatalf("expected error for telemetry path clashing with a profile")
+	}
+}
+
+// unevenTableQuerier returns a table with a short column.
+type unevenTableQuerier struct{}
+
+func (unevenTableQuerier) GrafanaQueryTable(ctx context.Context, target string, args simplejson.TableQueryArguments) ([]simplejson.TableColumn, error) {
+	return []simplejson.TableColumn{
+		{Text: "host", Data: simplejson.TableStringColumn{"a", "b", "c"}},
+		{Text: "latency", Data: simplejson.TableNumberColumn{1, 2}},
+	}, nil
+}
+
+func TestTableColumnLengthError(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithTableQuerier(unevenTableQuerier{}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"targets": [{"target": "hosts", "type": "table"}]}`)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	if expect := `column "latency" has 2 rows, expected 3`; strings.TrimSpace(w.Body.String()) != expect {
+		t.Fatalf("expected %q, got %q", expect, w.Body.String())
+	}
+}
+
+// brokenTargetQuerier fails queries for the "broken" target.
+type brokenTargetQuerier struct {
+	GSJExample
+}
+
+func (q brokenTargetQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	if target == "broken" {
+		return nil, errors.New("no such metric")
+	}
+	return q.GSJExample.GrafanaQuery(ctx, target, args)
+}
+
+func TestWithPartialResults(t *testing.T) {
+	for _, opts := range [][]simplejson.Opt{
+		{simplejson.WithPartialResults()},
+		{simplejson.WithPartialResults(), simplejson.WithStreamingQueries()},
+	} {
+		gsj := simplejson.New(append(opts, simplejson.WithQuerier(brokenTargetQuerier{}))...)
+
+		reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "upper_50"}, {"target": "broken"}, {"target": "upper_75"}]}`)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+		expect := `[{"target":"upper_50","datapoints":[[1234,1477917219866],[1500,1477917224866]]},{"target":"upper_75","datapoints":[[1234,1477917219866],[1500,1477917224866]]}]`
+		if w.Code != http.StatusOK || w.Body.String() != expect {
+			t.Fatalf("\nexpected: %s\ngot (%d): %s", expect, w.Code, w.Body.String())
+		}
+
+		reqBuf = bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "broken"}]}`)
+		w = httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status %d when every target fails, got %d", http.StatusInternalServerError, w.Code)
+		}
+	}
+}
+
+func TestAnnotationEndText(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithAnnotator(unfilteredAnnotator{
+			{Time: time.Unix(100, 0), TimeEnd: time.Unix(200, 0), Title: "deploy", Text: "deploy started", EndText: "deploy finished"},
+			{Time: time.Unix(300, 0), TimeEnd: time.Unix(400, 0), Title: "outage", Text: "outage"},
+		}),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": { "from": "2016-04-15T13:44:39.070Z", "to": "2016-04-15T14:44:39.070Z" }, "annotation": {"name":"query","query":"","enable":true}}`)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/annotations", reqBuf))
+
+	var resp []struct {
+		Title string `json:"title"`
+		Text  string `json:"text"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %s, %v", w.Body.String(), err)
+	}
+	var got []string
+	for _, a := range resp {
+		got = append(got, a.Title+": "+a.Text)
+	}
+	expect := []string{"deploy: deploy started", "deploy: deploy finished", "outage: outage", "outage: outage"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected %q, got %q", expect, got)
+	}
+}
+
+type hostVariableSearcher struct{}
+
+func (hostVariableSearcher) GrafanaVariableValues(ctx context.Context, name, payload string) ([]string, error) {
+	if name != "host" {
+		return nil, fmt.Errorf("unknown variable %q", name)
+	}
+	return []string{"web1", "web2:" + payload}, nil
+}
+
+func TestWithVariableSearcher(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithSearcher(GSJExample{}),
+		simplejson.WithVariableSearcher(hostVariableSearcher{}),
+	)
+
+	tests := []struct {
+		body   string
+		expect string
+	}{
+		{body: `{"target": "web.*"}`, expect: `["example1","example2","example3"]`},
+		{body: `{"target": "web.*", "variable": "host"}`, expect: `["web1","web2:web.*"]`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(tt.body)))
+		if w.Body.String() != tt.expect {
+			t.Errorf("%s: expected %s, got %s", tt.body, tt.expect, w.Body.String())
+		}
+	}
+}
+
+// countingQuerier returns the number of times it has been queried, and
+// signals each query on fetched.
+type countingQuerier struct {
+	sync.Mutex
+	calls   int
+	fetched chan struct{}
+}
+
+func (q *countingQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	q.Lock()
+	q.calls++
+	n := q.calls
+	q.Unlock()
+	q.fetched <- struct{}{}
+	return []simplejson.DataPoint{{Time: args.To, Value: float64(n)}}, nil
+}
+
+func TestWithStaleWhileRevalidate(t *testing.T) {
+	q := &countingQuerier{fetched: make(chan struct{}, 10)}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(q),
+		simplejson.WithQueryCache(10*time.Millisecond),
+		simplejson.WithStaleWhileRevalidate(time.Hour),
+	)
+
+	query := func() string {
+		reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "rangeRaw": {"from": "now-6h", "to": "now"}, "targets": [{"target": "a"}]}`)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	first := query()
+	<-q.fetched
+	if got := query(); got != first {
+		t.Fatalf("expected fresh cached response %s, got %s", first, got)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// A stale hit is served from the cache, and refreshed in the background.
+	if got := query(); got != first {
+		t.Fatalf("expected stale cached response %s, got %s", first, got)
+	}
+	select {
+	case <-q.fetched:
+	case <-time.After(time.Second):
+		t.Fatal("expected a background refresh")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for query() == first {
+		if time.Now().After(deadline) {
+			t.Fatal("expected refreshed response")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTargetTypeCase(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(seriesQuerier{{Time: time.Unix(1, 0), Value: 1}}),
+		simplejson.WithTableQuerier(GSJExample{}),
+	)
+
+	tests := []struct {
+		typ    string
+		expect string
+	}{
+		{typ: "timeserie", expect: `"datapoints"`},
+		{typ: "Timeserie", expect: `"datapoints"`},
+		{typ: "timeSeries", expect: `"datapoints"`},
+		{typ: "TIMESERIES", expect: `"datapoints"`},
+		{typ: "table", expect: `"type":"table"`},
+		{typ: "Table", expect: `"type":"table"`},
+		{typ: "tables", expect: `"type":"table"`},
+	}
+	for _, tt := range tests {
+		reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "upper_50", "type": "` + tt.typ + `"}]}`)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("type %q, expected status 200, got %d: %s", tt.typ, w.Code, w.Body.String())
+			continue
+		}
+		if !strings.Contains(w.Body.String(), tt.expect) {
+			t.Errorf("type %q, expected response containing %s, got %s", tt.typ, tt.expect, w.Body.String())
+		}
+	}
+}
+
+// argumentSearcher returns the type and payload of each search.
+type argumentSearcher struct{}
+
+func (argumentSearcher) GrafanaSearch(ctx context.Context, target string) ([]string, error) {
+	return nil, errors.New("expected GrafanaSearchArguments")
+}
+
+func (argumentSearcher) GrafanaSearchArguments(ctx context.Context, target string, args simplejson.SearchArguments) ([]string, error) {
+	return []string{target, args.Type, string(args.Payload)}, nil
+}
+
+func TestArgumentSearcher(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithSearcher(argumentSearcher{}),
+	)
+
+	tests := []struct {
+		body   string
+		expect string
+	}{
+		{body: `{"target": "x"}`, expect: `["x","",""]`},
+		{body: `{"target": "x", "type": "metrics", "payload": {"ns": "web"}}`, expect: `["x","metrics","{\"ns\": \"web\"}"]`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/search", bytes.NewBufferString(tt.body)))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("body %s, expected status 200, got %d: %s", tt.body, w.Code, w.Body.String())
+			continue
+		}
+		if got := w.Body.String(); got != tt.expect {
+			t.Errorf("body %s, expected %s, got %s", tt.body, tt.expect, got)
+		}
+	}
+}
+
+func TestWithAnnotationTextTemplate(t *testing.T) {
+	if _, err := simplejson.NewWithError(simplejson.WithAnnotationTextTemplate("{{.Title")); err == nil {
+		t.Fatal("expected error for invalid template")
+	}
+
+	gsj := simplejson.New(
+		simplejson.WithAnnotator(unfilteredAnnotator{
+			{Time: time.Unix(100, 0).UTC(), Title: "deploy", Text: "v1.2", Tags: []string{"web", "prod"}},
+		}),
+		simplejson.WithAnnotationTextTemplate(`{{.Title}} at {{.Time.Format "15:04:05"}}{{range .Tags}} #{{.}}{{end}}: {{.Text}}`),
+	)
+
+	for i := 0; i < 2; i++ {
+		reqBuf := bytes.NewBufferString(`{"range": { "from": "2016-04-15T13:44:39.070Z", "to": "2016-04-15T14:44:39.070Z" }, "annotation": {"name":"query","query":"","enable":true}}`)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/annotations", reqBuf))
+
+		var resp []struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response %s, %v", w.Body.String(), err)
+		}
+		expect := "deploy at 00:01:40 #web #prod: v1.2"
+		if len(resp) != 1 || resp[0].Text != expect {
+			t.Fatalf("expected text %q, got %s", expect, w.Body.String())
+		}
+	}
+}
+
+func TestWithStrictMethods(t *testing.T) {
+	tests := []struct {
+		opts   []simplejson.Opt
+		method string
+		path   string
+		expect int
+	}{
+		{method: http.MethodGet, path: "/search", expect: http.StatusOK},
+		{opts: []simplejson.Opt{simplejson.WithStrictMethods()}, method: http.MethodPost, path: "/search", expect: http.StatusOK},
+		{opts: []simplejson.Opt{simplejson.WithStrictMethods()}, method: http.MethodGet, path: "/search", expect: http.StatusMethodNotAllowed},
+		{opts: []simplejson.Opt{simplejson.WithStrictMethods()}, method: http.MethodDelete, path: "/query", expect: http.StatusMethodNotAllowed},
+		{opts: []simplejson.Opt{simplejson.WithStrictMethods()}, method: http.MethodGet, path: "/", expect: http.StatusOK},
+		{opts: []simplejson.Opt{simplejson.WithStrictMethods()}, method: http.MethodOptions, path: "/query", expect: http.StatusNoContent},
+		{opts: []simplejson.Opt{simplejson.WithStrictMethods()}, method: http.MethodOptions, path: "/tag-keys", expect: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		gsj := simplejson.New(append(tt.opts, simplejson.WithSearcher(GSJExample{}), simplejson.WithQuerier(GSJExample{}))...)
+
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(`{"target": "upper_50"}`)))
+
+		if w.Code != tt.expect {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.expect, w.Code)
+		}
+		if allow := w.Header().Get("Allow"); (tt.expect == http.StatusMethodNotAllowed || tt.method == http.MethodOptions) && allow != "POST, OPTIONS" {
+			t.Errorf("%s %s: expected Allow header, got %q", tt.method, tt.path, allow)
+		}
+	}
+}
+
+func TestTableBuilder(t *testing.T) {
+	tb := simplejson.NewTableBuilder(
+		simplejson.ColumnSpec{Text: "time", Type: simplejson.ColumnTime},
+		simplejson.ColumnSpec{Text: "host", Type: simplejson.ColumnString},
+		simplejson.ColumnSpec{Text: "load", Type: simplejson.ColumnNumber, Unit: "percent"},
+		simplejson.ColumnSpec{Text: "up", Type: simplejson.ColumnBool},
+	)
+
+	if err := tb.AppendRow(time.Unix(1, 0), "web1", 0.5, true); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err := tb.AppendRow(time.Unix(2, 0), "web2", 2, false); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err := tb.AppendRow(time.Unix(3, 0), "web3", "high", true); err == nil {
+		t.Fatal("expected error for invalid value")
+	}
+	if err := tb.AppendRow(time.Unix(3, 0), "web3"); err == nil {
+		t.Fatal("expected error for short row")
+	}
+
+	expect := []simplejson.TableColumn{
+		{Text: "time", Data: simplejson.TableTimeColumn{time.Unix(1, 0), time.Unix(2, 0)}},
+		{Text: "host", Data: simplejson.TableStringColumn{"web1", "web2"}},
+		{Text: "load", Data: simplejson.TableNumberColumn{0.5, 2}, Unit: "percent"},
+		{Text: "up", Data: simplejson.TableBoolColumn{true, false}},
+	}
+	if got := tb.Columns(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("\nexpected: %v\ngot: %v", expect, got)
+	}
+}
+
+func TestQueryCacheIdentity(t *testing.T) {
+	q := &countingQuerier{fetched: make(chan struct{}, 10)}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(q),
+		simplejson.WithQueryCache(time.Hour),
+	)
+
+	for _, org := range []string{"1", "2", "1"} {
+		reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "a"}]}`)
+		req := httptest.NewRequest(http.MethodPost, "/query", reqBuf)
+		req.Header.Set(simplejson.GrafanaOrgIDHeader, org)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("org %s, expected status 200, got %d: %s", org, w.Code, w.Body.String())
+		}
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if q.calls != 2 {
+		t.Errorf("expected 2 queries, one per org, got %d", q.calls)
+	}
+}
+
+func TestRowTableQuerierTimeserieQuery(t *testing.T) {
+	gsj := simplejson.New(
+		simplejson.WithQuerier(freshnessQuerier{}),
+		simplejson.WithTableQuerier(rowTableQuerier{}),
+		simplejson.WithSortSeriesByLastValue(true),
+	)
+
+	reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "upper_50"}, {"target": "upper_75"}]}`)
+	w := httptest.NewRecorder()
+	gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+
+	if cc := w.Header().Get("Cache-Control"); cc != "max-age=10" {
+		t.Errorf("expected Cache-Control %q, got %q", "max-age=10", cc)
+	}
+
+	var resp []struct {
+		DataPoints [][2]float64 `json:"datapoints"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %s, %v", w.Body.String(), err)
+	}
+	if len(resp) != 2 {
+		t.Fatalf("expected 2 series, got %s", w.Body.String())
+	}
+	last := func(i int) float64 { return resp[i].DataPoints[len(resp[i].DataPoints)-1][0] }
+	if last(0) < last(1) {
+		t.Errorf("expected series sorted by descending last value, got %s", w.Body.String())
+	}
+}
+
+// refreshPanicQuerier panics on every query after the first.
+type refreshPanicQuerier struct {
+	countingQuerier
+}
+
+func (q *refreshPanicQuerier) GrafanaQuery(ctx context.Context, target string, args simplejson.QueryArguments) ([]simplejson.DataPoint, error) {
+	dps, _ := q.countingQuerier.GrafanaQuery(ctx, target, args)
+	if dps[0].Value > 1 {
+		panic("refresh failed")
+	}
+	return dps, nil
+}
+
+// syncWriter is a buffer that may be written concurrently.
+type syncWriter struct {
+	sync.Mutex
+	w *bytes.Buffer
+}
+
+func (w *syncWriter) Write(bs []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.w.Write(bs)
+}
+
+func (w *syncWriter) String() string {
+	w.Lock()
+	defer w.Unlock()
+	return w.w.String()
+}
+
+func TestStaleWhileRevalidatePanic(t *testing.T) {
+	logs := &syncWriter{w: &bytes.Buffer{}}
+	q := &refreshPanicQuerier{countingQuerier{fetched: make(chan struct{}, 10)}}
+	gsj := simplejson.New(
+		simplejson.WithQuerier(q),
+		simplejson.WithQueryCache(10*time.Millisecond),
+		simplejson.WithStaleWhileRevalidate(time.Hour),
+		simplejson.WithLogger(log.New(logs, "", 0)),
+	)
+
+	query := func() int {
+		reqBuf := bytes.NewBufferString(`{"range": {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"}, "targets": [{"target": "a"}]}`)
+		w := httptest.NewRecorder()
+		gsj.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/query", reqBuf))
+		return w.Code
+	}
+
+	query()
+	<-q.fetched
+	time.Sleep(20 * time.Millisecond)
+
+	// Each stale hit starts a refresh, once the previous one has failed.
+	for i := 0; i < 2; i++ {
+		if code := query(); code != http.StatusOK {
+			t.Fatalf("expected stale response, got status %d", code)
+		}
+		select {
+		case <-q.fetched:
+		case <-time.After(time.Second):
+			t.Fatal("expected a background refresh")
+		}
+		deadline := time.Now().Add(time.Second)
+		for strings.Count(logs.String(), "refresh failed") <= i {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the panic to be logged")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
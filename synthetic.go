@@ -0,0 +1,117 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// SyntheticTargetPrefix is the target prefix reserved by WithSyntheticData.
+const SyntheticTargetPrefix = "__test__"
+
+// WithSyntheticData causes timeserie targets starting with
+// SyntheticTargetPrefix to be answered with generated data, without calling
+// the Querier, which is useful when building dashboards before a backend is
+// available. "__test__sine" returns a sine wave over the query range and
+// "__test__random" a random walk, seeded by the target so that it is stable
+// across refreshes.
+func WithSyntheticData() Opt {
+	return func(sjc *Handler) error {
+		sjc.synthetic = true
+		return nil
+	}
+}
+
+func (h *Handler) isSyntheticTarget(target string) bool {
+	return h.synthetic && strings.HasPrefix(target, SyntheticTargetPrefix)
+}
+
+// querier returns the Querier used to answer a target.
+func (h *Handler) querier(target string) Querier {
+	if h.isSyntheticTarget(target) {
+		return syntheticQuerier{}
+	}
+	return h.query
+}
+
+// syntheticMaxPoints limits the number of points in a synthetic series,
+// whatever the interval requested.
+const syntheticMaxPoints = 10000
+
+type syntheticQuerier struct{}
+
+func (syntheticQuerier) GrafanaQuery(ctx context.Context, target string, args QueryArguments) ([]DataPoint, error) {
+	to := args.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	from := args.From
+	if from.IsZero() {
+		from = to.Add(-time.Hour)
+	}
+	span := to.Sub(from)
+	if span <= 0 {
+		return nil, nil
+	}
+
+	step := args.Interval
+	if points := args.MaxDPs; step <= 0 && points > 0 {
+		step = span / time.Duration(points)
+	}
+	if step <= 0 {
+		step = span / 100
+	}
+	if step <= 0 {
+		step = time.Millisecond
+	}
+
+	maxPoints := syntheticMaxPoints
+	if args.MaxDPs > 0 && args.MaxDPs < maxPoints {
+		maxPoints = args.MaxDPs
+	}
+	if min := span / time.Duration(maxPoints); step < min {
+		step = min
+	}
+
+	var value func(t time.Time) float64
+	switch kind := strings.TrimPrefix(target, SyntheticTargetPrefix); kind {
+	case "", "sine":
+		value = func(t time.Time) float64 {
+			return math.Sin(2 * math.Pi * float64(t.Sub(from)) / float64(span))
+		}
+	case "random":
+		seed := fnv.New64a()
+		seed.Write([]byte(target))
+		rnd := rand.New(rand.NewSource(int64(seed.Sum64())))
+		v := 0.0
+		value = func(time.Time) float64 {
+			v += rnd.Float64() - 0.5
+			return v
+		}
+	default:
+		return nil, fmt.Errorf("unknown synthetic series %q, sine or random", kind)
+	}
+
+	var out []DataPoint
+	for t := from; !t.After(to) && len(out) < maxPoints; t = t.Add(step) {
+		out = append(out, DataPoint{Time: t, Value: value(t)})
+	}
+	return out, nil
+}
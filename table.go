@@ -0,0 +1,215 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// An Aggregation reduces the values of a numeric column to a single value.
+type Aggregation func([]float64) float64
+
+// AggregateSum sums the values.
+func AggregateSum(vs []float64) float64 {
+	sum := 0.0
+	for _, v := range vs {
+		sum += v
+	}
+	return sum
+}
+
+// AggregateAvg returns the mean of the values, or NaN if there are none.
+func AggregateAvg(vs []float64) float64 {
+	if len(vs) == 0 {
+		return math.NaN()
+	}
+	return AggregateSum(vs) / float64(len(vs))
+}
+
+// AggregateMin returns the smallest of the values, or NaN if there are none.
+func AggregateMin(vs []float64) float64 {
+	if len(vs) == 0 {
+		return math.NaN()
+	}
+	min := vs[0]
+	for _, v := range vs[1:] {
+		min = math.Min(min, v)
+	}
+	return min
+}
+
+// AggregateMax returns the largest of the values, or NaN if there are none.
+func AggregateMax(vs []float64) float64 {
+	if len(vs) == 0 {
+		return math.NaN()
+	}
+	max := vs[0]
+	for _, v := range vs[1:] {
+		max = math.Max(max, v)
+	}
+	return max
+}
+
+// AggregateFirst returns the first of the values, or NaN if there are none.
+func AggregateFirst(vs []float64) float64 {
+	if len(vs) == 0 {
+		return math.NaN()
+	}
+	return vs[0]
+}
+
+// AggregateLast returns the last of the values, or NaN if there are none.
+func AggregateLast(vs []float64) float64 {
+	if len(vs) == 0 {
+		return math.NaN()
+	}
+	return vs[len(vs)-1]
+}
+
+// TableSummary returns a copy of cols with a summary row appended, as a
+// footer. Number columns are summarised using agg, over their rows other
+// than any existing footer. The cells of other columns are sent as null,
+// they hold an empty string, the zero time or false.
+func TableSummary(cols []TableColumn, agg Aggregation) []TableColumn {
+	out := make([]TableColumn, len(cols))
+	for i, c := range cols {
+		out[i] = c
+		out[i].Footer = c.Footer + 1
+		switch data := c.Data.(type) {
+		case TableNumberColumn:
+			body := data
+			if c.Footer > 0 && c.Footer <= len(data) {
+				body = data[:len(data)-c.Footer]
+			}
+			out[i].Data = append(append(TableNumberColumn{}, data...), agg(body))
+		case TableStringColumn:
+			out[i].Data = append(append(TableStringColumn{}, data...), "")
+		case TableTimeColumn:
+			out[i].Data = append(append(TableTimeColumn{}, data...), time.Time{})
+		case TableBoolColumn:
+			out[i].Data = append(append(TableBoolColumn{}, data...), false)
+		}
+	}
+	return out
+}
+
+// A ColumnType is the type of the values of a table column.
+type ColumnType int
+
+// The supported column types, matching TableNumberColumn,
+// TableStringColumn, TableTimeColumn and TableBoolColumn.
+const (
+	ColumnNumber ColumnType = iota
+	ColumnString
+	ColumnTime
+	ColumnBool
+)
+
+// A ColumnSpec declares a column of a table built with a TableBuilder.
+type ColumnSpec struct {
+	Text  string
+	Type  ColumnType
+	Unit  string
+	Order int
+}
+
+// A TableBuilder builds the columns of a table from rows of values.
+type TableBuilder struct {
+	cols []TableColumn
+}
+
+// NewTableBuilder creates a TableBuilder for a table with the given
+// columns.
+func NewTableBuilder(colSpecs ...ColumnSpec) *TableBuilder {
+	tb := &TableBuilder{}
+	for _, cs := range colSpecs {
+		col := TableColumn{Text: cs.Text, Unit: cs.Unit, Order: cs.Order}
+		switch cs.Type {
+		case ColumnNumber:
+			col.Data = TableNumberColumn{}
+		case ColumnString:
+			col.Data = TableStringColumn{}
+		case ColumnTime:
+			col.Data = TableTimeColumn{}
+		case ColumnBool:
+			col.Data = TableBoolColumn{}
+		}
+		tb.cols = append(tb.cols, col)
+	}
+	return tb
+}
+
+// AppendRow adds a row to the table, with one value per column. Values of
+// number columns may be a float64, int or int64, other columns take a
+// string, time.Time or bool. If any value does not match its column, an
+// error is returned and the table is unchanged.
+func (tb *TableBuilder) AppendRow(values ...interface{}) error {
+	if len(values) != len(tb.cols) {
+		return fmt.Errorf("table row has %d values, expected %d", len(values), len(tb.cols))
+	}
+
+	for i, v := range values {
+		var ok bool
+		switch tb.cols[i].Data.(type) {
+		case TableNumberColumn:
+			_, ok = numberValue(v)
+		case TableStringColumn:
+			_, ok = v.(string)
+		case TableTimeColumn:
+			_, ok = v.(time.Time)
+		case TableBoolColumn:
+			_, ok = v.(bool)
+		default:
+			return fmt.Errorf("column %q has an unknown type", tb.cols[i].Text)
+		}
+		if !ok {
+			return fmt.Errorf("invalid value %v for column %q", v, tb.cols[i].Text)
+		}
+	}
+
+	for i, v := range values {
+		switch data := tb.cols[i].Data.(type) {
+		case TableNumberColumn:
+			f, _ := numberValue(v)
+			tb.cols[i].Data = append(data, f)
+		case TableStringColumn:
+			tb.cols[i].Data = append(data, v.(string))
+		case TableTimeColumn:
+			tb.cols[i].Data = append(data, v.(time.Time))
+		case TableBoolColumn:
+			tb.cols[i].Data = append(data, v.(bool))
+		}
+	}
+	return nil
+}
+
+// Columns returns the columns of the table, suitable for returning from
+// a TableQuerier.
+func (tb *TableBuilder) Columns() []TableColumn {
+	return append([]TableColumn(nil), tb.cols...)
+}
+
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A RowTableQuerier may be implemented by a TableQuerier to write large
+// tables a row at a time, rather than building every column in memory.
+// It is called in place of GrafanaQueryTable, and must call Columns on the
+// TableRowWriter before writing any rows. Rows are written to the client as
+// they are produced, so errors returned after Columns has been called cannot
+// be reported, and truncate the response. WithSortTableByTime has no
+// effect on such tables.
+type RowTableQuerier interface {
+	GrafanaQueryTableRows(ctx context.Context, target string, args TableQueryArguments, w *TableRowWriter) error
+}
+
+// A TableRowWriter writes the rows of a table response for a
+// RowTableQuerier.
+type TableRowWriter struct {
+	h     *Handler
+	out   *queryOutput
+	w     io.Writer
+	enc   *json.Encoder
+	cols  []simpleJSONTableColumn
+	rows  int
+	wrote bool
+}
+
+// Columns writes the column definitions of the table, which must be done
+// once, before any rows are written. The type of each column is taken
+// from its Data, which may be empty, e.g. TableNumberColumn(nil). Columns
+// are written in the order given.
+func (tw *TableRowWriter) Columns(cols ...TableColumn) error {
+	if tw.wrote {
+		return errors.New("table columns already written")
+	}
+	for _, c := range cols {
+		var colType string
+		switch c.Data.(type) {
+		case TableNumberColumn:
+			colType = "number"
+		case TableStringColumn:
+			colType = "string"
+		case TableTimeColumn:
+			colType = "time"
+		case TableBoolColumn:
+			colType = "bool"
+		default:
+			return errors.New("invalid column type")
+		}
+		tw.cols = append(tw.cols, simpleJSONTableColumn{Text: c.Text, Type: colType, Unit: c.Unit})
+	}
+	bs, err := tw.h.encode(tw.cols)
+	if err != nil {
+		return err
+	}
+
+	tw.wrote = true
+	tw.w = tw.out.next()
+	tw.enc = json.NewEncoder(tw.w)
+	tw.enc.SetEscapeHTML(!tw.h.noHTMLEscape)
+	tw.w.Write([]byte(`{"type":"table","columns":`))
+	tw.w.Write(bs)
+	_, err = tw.w.Write([]byte(`,"rows":[`))
+	return err
+}
+
+// WriteRow writes a single row of the table. There must be one value per
+// column, of type float64, string, time.Time or bool, matching the
+// column's type.
+func (tw *TableRowWriter) WriteRow(vals ...interface{}) error {
+	if !tw.wrote {
+		return errors.New("table columns must be written before rows")
+	}
+	if len(vals) != len(tw.cols) {
+		return fmt.Errorf("table row has %d values, expected %d", len(vals), len(tw.cols))
+	}
+
+	row := make(simpleJSONTableRow, len(vals))
+	for i, v := range vals {
+		var ok bool
+		switch tw.cols[i].Type {
+		case "number":
+			_, ok = v.(float64)
+		case "string":
+			_, ok = v.(string)
+		case "time":
+			_, ok = v.(time.Time)
+		case "bool":
+			_, ok = v.(bool)
+		}
+		if !ok {
+			return fmt.Errorf("invalid value %v for %s column %q", v, tw.cols[i].Type, tw.cols[i].Text)
+		}
+		row[i] = v
+		if tw.h.typedTableCells {
+			row[i] = simpleJSONTypedCell{Type: tw.cols[i].Type, Value: v}
+		}
+	}
+
+	if tw.rows > 0 {
+		tw.w.Write([]byte(","))
+	}
+	tw.rows++
+	return tw.enc.Encode(row)
+}
+
+// writtenEntry marks a query result that has already been written to the
+// response.
+type writtenEntry struct{}
+
+func (h *Handler) jsonRowTableQuery(ctx context.Context, rq RowTableQuerier, out *queryOutput, target string, args TableQueryArguments) (interface{}, error) {
+	tw := &TableRowWriter{h: h, out: out}
+	if err := rq.GrafanaQueryTableRows(ctx, target, args, tw); err != nil {
+		return nil, err
+	}
+
+	if !tw.wrote {
+		return simpleJSONTableData{Type: "table", Rows: []simpleJSONTableRow{}}, nil
+	}
+	if _, err := tw.w.Write([]byte("]}")); err != nil {
+		return nil, err
+	}
+	return writtenEntry{}, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMetricsPath is the path WithMetrics serves metrics on if no
+// path is given. It is deliberately distinct from /metrics, which newer
+// JSON datasource plugins use for data.
+const DefaultMetricsPath = "/debug/metrics"
+
+// dataPaths are the paths of the data endpoints, which the telemetry
+// endpoint must not clash with.
+var dataPaths = []string{"/", "/query", "/annotations", "/search", "/tag-keys", "/tag-values", "/variable", "/metric-payload-options"}
+
+// debugErrorsPath is the path of the WithErrorLog endpoint.
+const debugErrorsPath = "/debug/errors"
+
+// WithMetrics records the number and duration of the requests handled
+// by each endpoint, and serves them in the Prometheus text format on path,
+// or DefaultMetricsPath if path is empty. The path must not be that of
+// a data endpoint, /debug/errors, or lie below a profile added with
+// WithProfile.
+func WithMetrics(path string) Opt {
+	return func(sjc *Handler) error {
+		if path == "" {
+			path = DefaultMetricsPath
+		}
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("telemetry path %q must start with /", path)
+		}
+		for _, p := range dataPaths {
+			if path == p {
+				return fmt.Errorf("telemetry path %q clashes with a data endpoint", path)
+			}
+		}
+		if path == debugErrorsPath {
+			return fmt.Errorf("telemetry path %q clashes with the error log endpoint", path)
+		}
+		sjc.telemetry = &telemetry{path: path, endpoints: map[string]*endpointStats{}}
+		return nil
+	}
+}
+
+// checkMetricsPath reports an error if the telemetry path clashes with the
+// routes of a profile. Profiles may be added after WithMetrics, so this is
+// checked once all options have been applied.
+func (h *Handler) checkMetricsPath() error {
+	if h.telemetry == nil {
+		return nil
+	}
+	for name := range h.profiles {
+		prefix := "/" + name
+		if h.telemetry.path == prefix || strings.HasPrefix(h.telemetry.path, prefix+"/") {
+			return fmt.Errorf("telemetry path %q clashes with profile %q", h.telemetry.path, name)
+		}
+	}
+	return nil
+}
+
+type endpointStats struct {
+	codes    map[int]int
+	count    int
+	duration time.Duration
+}
+
+type telemetry struct {
+	sync.Mutex
+	path      string
+	endpoints map[string]*endpointStats
+}
+
+func (t *telemetry) observe(endpoint string, rw *accessLogWriter, start time.Time) {
+	d := time.Since(start)
+
+	t.Lock()
+	defer t.Unlock()
+	s, ok := t.endpoints[endpoint]
+	if !ok {
+		s = &endpointStats{codes: map[int]int{}}
+		t.endpoints[endpoint] = s
+	}
+	s.codes[rw.status]++
+	s.count++
+	s.duration += d
+}
+
+// HandleTelemetry serves the metrics recorded by WithMetrics.
+func (h *Handler) HandleTelemetry(w http.ResponseWriter, r *http.Request) {
+	t := h.telemetry
+	t.Lock()
+	defer t.Unlock()
+
+	var endpoints []string
+	for e := range t.endpoints {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "# HELP simplejson_requests_total Requests handled, by endpoint and status code.")
+	fmt.Fprintln(b, "# TYPE simplejson_requests_total counter")
+	for _, e := range endpoints {
+		var codes []int
+		for c := range t.endpoints[e].codes {
+			codes = append(codes, c)
+		}
+		sort.Ints(codes)
+		for _, c := range codes {
+			fmt.Fprintf(b, "simplejson_requests_total{endpoint=%q,code=\"%d\"} %d\n", e, c, t.endpoints[e].codes[c])
+		}
+	}
+	fmt.Fprintln(b, "# HELP simplejson_request_duration_seconds Time taken to handle requests, by endpoint.")
+	fmt.Fprintln(b, "# TYPE simplejson_request_duration_seconds summary")
+	for _, e := range endpoints {
+		s := t.endpoints[e]
+		fmt.Fprintf(b, "simplejson_request_duration_seconds_sum{endpoint=%q} %s\n", e, strconv.FormatFloat(s.duration.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(b, "simplejson_request_duration_seconds_count{endpoint=%q} %d\n", e, s.count)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 Qubit Digital Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simplejson
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// WithVariableResolver adds a template variable query handler.
+func WithVariableResolver(vr VariableResolver) Opt {
+	return func(sjc *Handler) error {
+		sjc.variables = vr
+		return nil
+	}
+}
+
+// VariableArguments defines the options to a template variable query.
+// Variables holds the current values of other template variables the
+// query depends on, keyed by variable name, allowing dependent variable
+// lists. Payload holds the raw payload as sent by the client.
+type VariableArguments struct {
+	QueryCommonArguments
+	Variables map[string][]string
+	Payload   json.RawMessage
+}
+
+// VariableOption is a single option of a template variable.
+type VariableOption struct {
+	Text  string
+	Value string
+}
+
+// A VariableResolver responds to template variable queries from Grafana.
+type VariableResolver interface {
+	GrafanaVariable(ctx context.Context, target string, args VariableArguments) ([]VariableOption, error)
+}
+
+// simpleJSONVariableValues holds variable values, which may be sent as a
+// single string or, for multi-value variables, an array of strings.
+type simpleJSONVariableValues []string
+
+func (v *simpleJSONVariableValues) UnmarshalJSON(injs []byte) error {
+	var one string
+	if err := json.Unmarshal(injs, &one); err == nil {
+		*v = simpleJSONVariableValues{one}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(injs, &many); err != nil {
+		return err
+	}
+	*v = simpleJSONVariableValues(many)
+	return nil
+}
+
+/*
+{
+  "payload": {
+    "target": "hosts",
+    "variables": {
+      "datacenter": "eu-west",
+      "role": ["web", "db"]
+    }
+  },
+  "range": {
+    "from": "2016-10-31T06:33:44.866Z",
+    "to": "2016-10-31T12:33:44.866Z"
+  },
+  "rangeRaw": {
+    "from": "now-6h",
+    "to": "now"
+  }
+}
+*/
+
+type simpleJSONVariablePayload struct {
+	Target    string                              `json:"target"`
+	Variables map[string]simpleJSONVariableValues `json:"variables"`
+}
+
+type simpleJSONVariableQuery struct {
+	Payload  json.RawMessage    `json:"payload"`
+	Range    simpleJSONRange    `json:"range"`
+	RangeRaw simpleJSONRawRange `json:"rangeRaw"`
+}
+
+type simpleJSONVariableOption struct {
+	Text  string `json:"__text"`
+	Value string `json:"__value"`
+}
+
+// HandleVariable implements the /variable endpoint. The request payload
+// holds the variable's query target along with the values of any other
+// variables it depends on:
+//
+//	{"payload": {"target": "hosts", "variables": {"dc": "eu", "role": ["web", "db"]}}}
+//
+// Variable values may be a single string or an array of strings.
+func (h *Handler) HandleVariable(w http.ResponseWriter, r *http.Request) {
+	if h.variables == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+
+	req := simpleJSONVariableQuery{}
+	if err := h.decodeRequest(w, r, &req); err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.resolveRange(&req.Range, req.RangeRaw, nil); err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	payload := simpleJSONVariablePayload{}
+	if len(req.Payload) > 0 {
+		if err := json.Unmarshal(req.Payload, &payload); err != nil {
+			h.writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	vars := map[string][]string{}
+	for k, v := range payload.Variables {
+		vars[k] = []string(v)
+	}
+
+	opts, err := h.variables.GrafanaVariable(
+		ctx,
+		payload.Target,
+		VariableArguments{
+			QueryCommonArguments: QueryCommonArguments{
+				From: time.Time(req.Range.From),
+				To:   time.Time(req.Range.To),
+			},
+			Variables: vars,
+			Payload:   req.Payload,
+		})
+	if err != nil {
+		h.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	out := []simpleJSONVariableOption{}
+	for _, o := range opts {
+		out = append(out, simpleJSONVariableOption{Text: o.Text, Value: o.Value})
+	}
+
+	bs, err := h.marshal(out)
+	if err != nil {
+		h.writeError(w, r, err, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}